@@ -26,21 +26,18 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 
-	"github.com/bfix/gospel/logger"
 	"github.com/bfix/plumber/lib"
 )
 
 func main() {
 	var rules string
 	flag.StringVar(&rules, "p", "", "name of plumbing file")
+	verbose := flag.Bool("v", false, "log evaluation steps")
 	flag.Parse()
 
-	// setup logging
-	logger.SetLogLevelFromName("DBG")
-	logger.UseFormat(logger.ColorFormat)
-
 	exec := func(msg *lib.Message, verb, data string) (ok, done bool) {
 		log.Printf("==> %s %s", verb, lib.Quote(data))
 		log.Printf("    Attr: %s", msg.GetAttr())
@@ -54,6 +51,10 @@ func main() {
 	}
 
 	plmb := lib.NewPlumber(worker)
+	if *verbose {
+		// log the evaluation steps
+		plmb.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
 	home, _ := os.UserHomeDir()
 	fallback := home + "/lib/plumbing"
 	if err := plmb.ParsePlumbingFile(rules, fallback); err != nil {
@@ -0,0 +1,193 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// fileAccess defines owner, group and permissions of a file
+type fileAccess struct {
+	uid  string
+	gid  string
+	mode uint32
+}
+
+// Access rules for files in the plumber namespace. Permissions are
+// checked like on Plan9: the owner bits apply to the owner of a file,
+// the group bits to members of the file group and the other bits to
+// everyone else. A user is always member of the group of the same name.
+type Access struct {
+	Owner  string                 // default owner and group of files
+	Stamp  bool                   // replace 'src' of messages with sender
+	groups map[string][]string    // group members
+	files  map[string]*fileAccess // access to named files ("*" for ports)
+}
+
+// Anonymous is the user of clients that are not authenticated
+const Anonymous = "none"
+
+// NewAccess returns the default access rules (files are owned by the
+// user running the plumber and only protected by their default mode).
+func NewAccess() *Access {
+	owner := "plumb"
+	if u, err := user.Current(); err == nil {
+		owner = u.Username
+	}
+	return &Access{
+		Owner:  owner,
+		groups: make(map[string][]string),
+		files:  make(map[string]*fileAccess),
+	}
+}
+
+// ReadAccess reads access rules from a file
+func ReadAccess(fname string) (*Access, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseAccess(f)
+}
+
+// ParseAccess reads access rules from a reader. Each line is one of
+//
+//	owner <user>                          default owner of files
+//	group <name> <member> ...             group definition
+//	file  <name> <owner> <group> <mode>   access to a file ("*" for ports)
+//	stamp                                 stamp 'src' with sender
+//
+// Empty lines and comments (starting with '#') are ignored.
+func ParseAccess(in io.Reader) (*Access, error) {
+	a := NewAccess()
+	rdr := bufio.NewScanner(in)
+	for num := 1; rdr.Scan(); num++ {
+		line := strings.TrimSpace(rdr.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		parts := strings.Fields(line)
+		ok := true
+		switch parts[0] {
+		case "owner":
+			if ok = len(parts) == 2; ok {
+				a.Owner = parts[1]
+			}
+		case "group":
+			if ok = len(parts) >= 2; ok {
+				a.groups[parts[1]] = parts[2:]
+			}
+		case "file":
+			if ok = len(parts) == 5; ok {
+				var mode uint64
+				if mode, ok = parseMode(parts[4]); ok {
+					a.files[parts[1]] = &fileAccess{
+						uid:  parts[2],
+						gid:  parts[3],
+						mode: uint32(mode),
+					}
+				}
+			}
+		case "stamp":
+			a.Stamp = true
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, fmt.Errorf("access rules line %d: invalid entry '%s'", num, line)
+		}
+	}
+	return a, rdr.Err()
+}
+
+// parse octal permission bits
+func parseMode(s string) (uint64, bool) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	return mode, err == nil && mode <= 0777
+}
+
+// NewStat returns the stat of a file with owner, group and mode from the
+// access rules. Without matching rule the file is owned by the default
+// owner and has mode 'perm'.
+func (a *Access) NewStat(fsys *fs.FS, name string, perm uint32, port bool) *proto.Stat {
+	e, ok := a.files[name]
+	if !ok && port {
+		e, ok = a.files["*"]
+	}
+	if !ok {
+		e = &fileAccess{a.Owner, a.Owner, perm}
+	}
+	return fsys.NewStat(name, e.uid, e.gid, e.mode)
+}
+
+// Root returns owner, group and mode of the root directory (entry "/"
+// in the access rules). By default only the owner (and members of the
+// owner's group) can create files (ad-hoc ports) in the root directory.
+func (a *Access) Root() (uid, gid string, mode uint32) {
+	if e, ok := a.files["/"]; ok {
+		return e.uid, e.gid, e.mode
+	}
+	return a.Owner, a.Owner, 0775
+}
+
+// InGroup returns true if the user is member of the group
+func (a *Access) InGroup(user, group string) bool {
+	return user == group || slices.Contains(a.groups[group], user)
+}
+
+// Permit returns true if the user is allowed to open a node in the
+// given mode.
+func (a *Access) Permit(n fs.FSNode, user string, omode proto.Mode) bool {
+	st := n.Stat()
+	perm := st.Mode
+	switch {
+	case user == st.Uid:
+		perm >>= 6
+	case a.InGroup(user, st.Gid):
+		perm >>= 3
+	}
+	var need uint32
+	switch omode & 3 {
+	case proto.Oread:
+		need = 4
+	case proto.Owrite:
+		need = 2
+	case proto.Ordwr:
+		need = 6
+	case proto.Oexec:
+		need = 1
+	}
+	if omode&proto.Otrunc != 0 {
+		need |= 2
+	}
+	return perm&need == need
+}
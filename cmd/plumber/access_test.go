@@ -0,0 +1,126 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+const testAccess = `
+# plumber is run by glenda
+owner	glenda
+group	devs	alice
+file	rules	glenda	glenda	0644
+file	send	glenda	glenda	0222
+file	edit	glenda	devs	0440
+file	*	glenda	glenda	0400
+stamp
+`
+
+func TestAccessParse(t *testing.T) {
+	a, err := ParseAccess(strings.NewReader(testAccess))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Owner != "glenda" || !a.Stamp {
+		t.Fatal("settings mismatch")
+	}
+	if !a.InGroup("alice", "devs") || a.InGroup("bob", "devs") || !a.InGroup("bob", "bob") {
+		t.Fatal("group mismatch")
+	}
+	for _, line := range []string{"file rules glenda", "file send a b 0999", "allow all"} {
+		if _, err = ParseAccess(strings.NewReader(line)); err == nil {
+			t.Fatalf("invalid entry '%s' accepted", line)
+		}
+	}
+}
+
+func TestAccessNamespace(t *testing.T) {
+	p := NewPlumber()
+	p.Dry.Store(true)
+	var err error
+	if p.Access, err = ParseAccess(strings.NewReader(testAccess)); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.ParsePlumbingFromRdr(strings.NewReader(testRules)); err != nil {
+		t.Fatal(err)
+	}
+	p.NamespaceService()
+
+	glenda := dial(t, p, "glenda")
+	alice := dial(t, p, "alice")
+	bob := dial(t, p, "bob")
+
+	checks := []struct {
+		user string
+		file string
+		mode proto.Mode
+		ok   bool
+	}{
+		{"glenda", "rules", proto.Owrite, true},
+		{"alice", "rules", proto.Oread, true},
+		{"alice", "rules", proto.Owrite, false},
+		{"bob", "rules", proto.Oread | proto.Otrunc, false},
+		{"alice", "edit", proto.Oread, true},
+		{"bob", "edit", proto.Oread, false},
+		{"glenda", "web", proto.Oread, true},
+		{"alice", "web", proto.Oread, false},
+		{"bob", "send", proto.Owrite, true},
+		{"bob", "send", proto.Oread, false},
+	}
+	clients := map[string]*client.Client{"glenda": glenda, "alice": alice, "bob": bob}
+	for _, c := range checks {
+		f, err := clients[c.user].Open(c.file, c.mode)
+		if err == nil {
+			f.Close()
+		}
+		if c.ok != (err == nil) {
+			t.Fatalf("%s opening %s (%d): %v", c.user, c.file, c.mode, err)
+		}
+		if err != nil && err.Error() != ErrPerm.Error() {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	// messages are stamped with the sender
+	port, err := alice.Open("edit", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	res := readAsync(port, 8192)
+	msg := lib.NewMessage("glenda", "", "/", "text", "main.go")
+	if err = plumb(bob, []byte(msg.String())); err != nil {
+		t.Fatal(err)
+	}
+	out, err := lib.ParseMessage(await(t, res))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Src != "bob" {
+		t.Fatalf("message not stamped: src=%s", out.Src)
+	}
+}
@@ -0,0 +1,219 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+const testRules = `
+editor = acme
+
+type	is	text
+data	matches	'[a-zA-Z0-9_\-./]+\.go'
+plumb	to	edit
+
+type	is	text
+data	matches	'https?://[^ ]+'
+plumb	to	web
+`
+
+// newTestPlumber returns a plumber with namespace for the given rules
+func newTestPlumber(t *testing.T, rules string, compat bool) *Plumber {
+	t.Helper()
+	p := NewPlumber()
+	p.Dry.Store(true)
+	p.Compat = compat
+	p.Access.Owner = "glenda"
+	if compat {
+		p.PortCfg = NewPortConfigs(true)
+	}
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	p.NamespaceService()
+	return p
+}
+
+// dial connects a new 9P client (as user) to the plumber service
+func dial(t *testing.T, p *Plumber, user string) *client.Client {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Serve(c1, c1, p.srv)
+		close(done)
+	}()
+	cl, err := client.NewClient(c2, user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the connection to be released
+	t.Cleanup(func() {
+		c2.Close()
+		<-done
+	})
+	return cl
+}
+
+// read a single response from a file with given buffer size (async)
+func readAsync(f *client.File, size int) <-chan string {
+	ch := make(chan string, 1)
+	go func() {
+		buf := make([]byte, size)
+		n, err := f.Read(buf)
+		if err != nil {
+			ch <- "error: " + err.Error()
+			return
+		}
+		ch <- string(buf[:n])
+	}()
+	return ch
+}
+
+// wait for result of an async operation
+func await(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case s := <-ch:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	return ""
+}
+
+// plumb sends a message as plumb(1) does: open, single write, clunk.
+func plumb(cl *client.Client, msg []byte) error {
+	f, err := cl.Open("send", proto.Owrite)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(msg)
+	return err
+}
+
+// The conversations below follow the 9P requests issued by plan9port
+// clients: plumb(1) opens 'send', writes a single packed message and
+// clunks; acme opens its port once and reads with an 8K buffer
+// (plumbrecv) for every message.
+
+func TestCompatConversation(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	acme := dial(t, p, "glenda")
+	sender := dial(t, p, "glenda")
+
+	port, err := acme.Open("edit", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	msgs := []*lib.Message{
+		lib.NewMessage("plumb", "", "/usr/glenda/src", "text", "cmd/plumber/main.go"),
+		lib.NewMessage("acme", "edit", "/usr/glenda", "text", "any text\nwith two lines"),
+	}
+	msgs[0].Attr["addr"] = "#42"
+	for _, msg := range msgs {
+		res := readAsync(port, 8192)
+		if err = plumb(sender, msg.Pack()); err != nil {
+			t.Fatal(err)
+		}
+		out := msg.Clone()
+		out.Type = "text"
+		if got, exp := await(t, res), string(out.Pack()); got != exp {
+			t.Logf("got: %q", got)
+			t.Logf("exp: %q", exp)
+			t.Fatal("mismatch")
+		}
+	}
+}
+
+func TestCompatShortReads(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	acme := dial(t, p, "glenda")
+	sender := dial(t, p, "glenda")
+
+	port, err := acme.Open("web", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	msg1 := lib.NewMessage("plumb", "", "/", "text", "https://9p.io/plan9/")
+	msg2 := lib.NewMessage("plumb", "", "/", "text", "http://p9f.org")
+	go func() {
+		plumb(sender, msg1.Pack())
+		plumb(sender, msg2.Pack())
+	}()
+
+	// reads never cross message boundaries
+	var parts []string
+	for _, exp := range [][]byte{msg1.Pack(), msg2.Pack()} {
+		got := ""
+		for len(got) < len(exp) {
+			s := await(t, readAsync(port, 16))
+			if len(s) > 16 {
+				t.Fatalf("read too long: %d", len(s))
+			}
+			got += s
+			parts = append(parts, s)
+		}
+		if got != string(exp) {
+			t.Logf("got: %q", got)
+			t.Logf("exp: %q", string(exp))
+			t.Fatal("mismatch")
+		}
+	}
+	t.Logf("%d reads", len(parts))
+}
+
+func TestCompatErrors(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	cl := dial(t, p, "glenda")
+
+	check := func(err error, exp error) {
+		t.Helper()
+		if err == nil || err.Error() != exp.Error() {
+			t.Fatalf("expected error '%v', got '%v'", exp, err)
+		}
+	}
+	_, err := cl.Open("send", proto.Oread)
+	check(err, ErrPerm)
+	_, err = cl.Open("edit", proto.Owrite)
+	check(err, ErrPerm)
+	_, err = cl.Open("nonexistent", proto.Oread)
+	check(err, ErrNotExist)
+
+	check(plumb(cl, []byte("src\ndst\nwdir\ntext\n\nmany\ndata")), ErrBadMsg)
+	msg := lib.NewMessage("plumb", "", "/", "text", "no rule for this")
+	check(plumb(cl, msg.Pack()), ErrNoRule)
+	msg.Dst = "nowhere"
+	check(plumb(cl, msg.Pack()), ErrNoPort)
+}
@@ -0,0 +1,239 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// CtlFile ('/mnt/plumb/ctl') administers a running plumber: every line
+// written to the file is a command that acts on the live plumber.
+// Reading the file returns the current settings (as commands) and the
+// counters of dropped messages (as comments).
+type CtlFile struct {
+	fs.BaseFile
+
+	content map[uint64][]byte // fid-mapped settings (on open)
+	partial map[uint64][]byte // fid-mapped incomplete lines written
+	plmb    *Plumber          // reference to plumber instance
+}
+
+// NewCtlFile creates a new control file
+func NewCtlFile(s *proto.Stat, plmb *Plumber) *CtlFile {
+	return &CtlFile{
+		BaseFile: *fs.NewBaseFile(s),
+		content:  make(map[uint64][]byte),
+		partial:  make(map[uint64][]byte),
+		plmb:     plmb,
+	}
+}
+
+// Open control file
+func (f *CtlFile) Open(fid uint64, omode proto.Mode) error {
+	f.Lock()
+	defer f.Unlock()
+	f.content[fid] = f.plmb.Settings()
+	return nil
+}
+
+// Read current settings (as of opening the file)
+func (f *CtlFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	data := f.content[fid]
+	flen := uint64(len(data))
+	if ofs >= flen {
+		return []byte{}, nil
+	}
+	last := min(ofs+count, flen)
+	return data[ofs:last], nil
+}
+
+// Write control commands (one per line); offsets are ignored. Complete
+// lines are executed in order; an incomplete line is kept until the
+// next write (or close). If a command fails, the rest of the data is
+// discarded: the failure is reported if no command of the write was
+// executed, otherwise the write is short (up to the failing command).
+func (f *CtlFile) Write(fid uint64, ofs uint64, buf []byte) (uint32, error) {
+	f.Lock()
+	data := append(f.partial[fid], buf...)
+	pos := bytes.LastIndexByte(data, '\n') + 1
+	f.partial[fid] = data[pos:]
+	f.Unlock()
+
+	n, err := f.run(data[:pos])
+	if err != nil {
+		f.Lock()
+		delete(f.partial, fid)
+		f.Unlock()
+		if done := n - (len(data) - len(buf)); done > 0 {
+			return uint32(done), nil
+		}
+		return 0, err
+	}
+	return uint32(len(buf)), nil
+}
+
+// Close control file: a pending incomplete line is executed.
+func (f *CtlFile) Close(fid uint64) error {
+	f.Lock()
+	data := f.partial[fid]
+	delete(f.partial, fid)
+	delete(f.content, fid)
+	f.Unlock()
+	_, err := f.run(data)
+	return err
+}
+
+// run commands (one per line) up to the first failing command. Returns
+// the number of bytes processed without failure.
+func (f *CtlFile) run(data []byte) (int, error) {
+	n := 0
+	for len(data) > n {
+		line, _, _ := bytes.Cut(data[n:], []byte{'\n'})
+		cmd := strings.TrimSpace(string(line))
+		if len(cmd) > 0 && cmd[0] != '#' {
+			if err := f.plmb.Control(cmd); err != nil {
+				slog.Warn("ctl command failed", "command", cmd, "error", err)
+				return n, err
+			}
+			slog.Info("ctl command", "command", cmd)
+		}
+		n = min(n+len(line)+1, len(data))
+	}
+	return n, nil
+}
+
+//----------------------------------------------------------------------
+
+// Control executes a control command:
+//
+//	reload                  reload the plumbing file
+//	dry on|off              switch dry run (no programs are started)
+//	loglevel <level>        set log level
+//	disable ruleset <ref>   skip a ruleset (name or index)
+//	enable ruleset <ref>    re-enable a ruleset (name or index)
+//	set <name>=<value>      set a variable of the rules (or remove it)
+//	flush port <name>       discard messages queued on a port
+//	replay <id>             dispatch a message of the history again
+//
+// Changes of the rules are serialized with other rule changes (like a
+// reload); they last until the rules are replaced.
+func (p *Plumber) Control(cmd string) error {
+	verb, args, _ := strings.Cut(cmd, " ")
+	args = strings.TrimSpace(args)
+	switch verb {
+	case "reload":
+		return p.Reload()
+	case "dry":
+		switch args {
+		case "on":
+			p.Dry.Store(true)
+		case "off":
+			p.Dry.Store(false)
+		default:
+			return fmt.Errorf("invalid dry mode '%s'", args)
+		}
+		return nil
+	case "loglevel":
+		return SetLogLevel(args)
+	case "disable", "enable":
+		ref, ok := strings.CutPrefix(args, "ruleset ")
+		if !ok {
+			break
+		}
+		return p.EnableRuleset(strings.TrimSpace(ref), verb == "enable")
+	case "set":
+		key, val, ok := strings.Cut(args, "=")
+		if !ok {
+			return fmt.Errorf("invalid setting '%s'", args)
+		}
+		return p.SetEnv(strings.TrimSpace(key), strings.TrimSpace(val))
+	case "flush":
+		name, ok := strings.CutPrefix(args, "port ")
+		if !ok {
+			break
+		}
+		name = strings.TrimSpace(name)
+		f := p.port(name)
+		if f == nil {
+			return ErrNoPort
+		}
+		if n := f.Flush(); n > 0 {
+			slog.Info("messages flushed", "port", name, "count", n)
+		}
+		return nil
+	case "replay":
+		id, err := strconv.ParseUint(args, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid message id '%s'", args)
+		}
+		return p.Replay(id)
+	}
+	return fmt.Errorf("unknown control command '%s'", cmd)
+}
+
+// Settings returns the current settings as control commands followed by
+// the number of messages dropped on ports (and for snoop readers) as
+// comments, e.g. "# port edit dropped 3".
+func (p *Plumber) Settings() []byte {
+	buf := new(bytes.Buffer)
+	dry := "off"
+	if p.Dry.Load() {
+		dry = "on"
+	}
+	fmt.Fprintf(buf, "dry %s\n", dry)
+	fmt.Fprintf(buf, "loglevel %s\n", LogLevel())
+	for i, rs := range p.Rulesets() {
+		if rs.Disabled {
+			fmt.Fprintf(buf, "disable ruleset %s\n", lib.Ref{Index: i, Name: rs.Name})
+		}
+	}
+	env := p.Env()
+	keys := slices.Sorted(maps.Keys(env))
+	for _, key := range keys {
+		fmt.Fprintf(buf, "set %s=%s\n", key, env[key])
+	}
+	p.pLock.RLock()
+	names := slices.Sorted(maps.Keys(p.ports))
+	for _, name := range names {
+		if n := p.ports[name].Dropped(); n > 0 {
+			fmt.Fprintf(buf, "# port %s dropped %d\n", name, n)
+		}
+	}
+	p.pLock.RUnlock()
+	if p.snoop != nil {
+		if n := p.snoop.Dropped(); n > 0 {
+			fmt.Fprintf(buf, "# snoop dropped %d\n", n)
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,202 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// ctl writes a command to the control file
+func ctl(cl *client.Client, cmd string) error {
+	f, err := cl.Open("ctl", proto.Owrite)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write([]byte(cmd + "\n"))
+	return err
+}
+
+// settings reads the control file
+func settings(t *testing.T, cl *client.Client) string {
+	t.Helper()
+	f, err := cl.Open("ctl", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCtl(t *testing.T) {
+	level := LogLevel()
+	t.Cleanup(func() { SetLogLevel(level) })
+
+	p := newPortPlumber(t, "")
+	cl := dial(t, p, "glenda")
+	for _, cmd := range []string{"dry off", "loglevel INFO", "set editor=sam", "disable ruleset 1"} {
+		if err := ctl(cl, cmd); err != nil {
+			t.Fatalf("%s: %s", cmd, err)
+		}
+	}
+	exp := "dry off\nloglevel INFO\ndisable ruleset 1\nset editor=sam\n"
+	if got := settings(t, cl); got != exp {
+		t.Fatalf("settings: got %q, expected %q", got, exp)
+	}
+	if p.Dry.Load() {
+		t.Fatal("dry run still on")
+	}
+	p.Dry.Store(true)
+
+	// disabled rulesets don't match
+	msg := lib.NewMessage("plumb", "", "/", "text", "https://9p.io/")
+	if done, _ := p.Dispatch(msg); done {
+		t.Fatal("disabled ruleset matched")
+	}
+	if err := ctl(cl, "enable ruleset 1"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(settings(t, cl), "disable") {
+		t.Fatal("ruleset still disabled")
+	}
+	for _, cmd := range []string{
+		"bogus", "dry maybe", "loglevel LOUD", "disable ruleset 9",
+		"enable 1", "set editor", "flush port none", "reload",
+	} {
+		if ctl(cl, cmd) == nil {
+			t.Errorf("'%s' accepted", cmd)
+		}
+	}
+}
+
+func TestCtlNamedRuleset(t *testing.T) {
+	rules := "ruleset name: go-files\ntype is text\ndata matches '.*\\.go'\nplumb to edit\n"
+	p := newTestPlumber(t, rules, true)
+	cl := dial(t, p, "glenda")
+	if err := ctl(cl, "disable ruleset go-files"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(settings(t, cl), "disable ruleset go-files\n") {
+		t.Fatal("named ruleset not disabled")
+	}
+	if err := ctl(cl, "enable ruleset 0"); err != nil {
+		t.Fatal(err)
+	}
+	if p.Rulesets()[0].Disabled {
+		t.Fatal("ruleset still disabled")
+	}
+}
+
+func TestCtlWrites(t *testing.T) {
+	p := newPortPlumber(t, "")
+	rc := newRawConn(t, p)
+	rc.rpc(&proto.TRVersion{Header: proto.Header{Type: proto.Tversion, Tag: 0xffff}, Msize: 8192, Version: "9P2000"})
+	rc.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach}, Fid: 0, Afid: ^uint32(0), Uname: "glenda"})
+	rc.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk}, Fid: 0, Newfid: 1, Nwname: 1, Wname: []string{"ctl"}})
+	rc.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen}, Fid: 1, Mode: proto.Owrite})
+	write := func(data string) proto.FCall {
+		rc.send(&proto.TWrite{Header: proto.Header{Type: proto.Twrite}, Fid: 1, Count: uint32(len(data)), Data: []byte(data)})
+		return rc.reply()
+	}
+	// a command split across writes is executed when complete
+	write("dry o")
+	if !p.Dry.Load() {
+		t.Fatal("incomplete command executed")
+	}
+	write("ff\n")
+	if p.Dry.Load() {
+		t.Fatal("split command not executed")
+	}
+	// commands before a failing command are reported as written
+	if r, ok := write("dry on\nbogus\ndry off\n").(*proto.RWrite); !ok || r.Count != 7 {
+		t.Fatalf("expected short write, got %v", r)
+	}
+	if !p.Dry.Load() {
+		t.Fatal("command after failure executed")
+	}
+	if _, ok := write("bogus\n").(*proto.RError); !ok {
+		t.Fatal("failing command accepted")
+	}
+	// only the owner can use the control file
+	if _, err := dial(t, p, "alice").Open("ctl", proto.Oread); err == nil {
+		t.Fatal("ctl opened by other user")
+	}
+}
+
+func TestCtlFlush(t *testing.T) {
+	p := newPortPlumber(t, "")
+	cl := dial(t, p, "glenda")
+	reader := openPorts(t, p, "edit", 1)[0]
+	for _, data := range []string{"a.go", "b.go"} {
+		if err := plumb(cl, p.Pack(lib.NewMessage("plumb", "", "/", "text", data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ctl(cl, "flush port edit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := plumb(cl, p.Pack(lib.NewMessage("plumb", "", "/", "text", "c.go"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := await(t, readAsync(reader, 8192)); !strings.Contains(got, "c.go") {
+		t.Fatalf("read after flush: %q", got)
+	}
+}
+
+func TestCtlReload(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "plumbing")
+	if err := os.WriteFile(fname, []byte(testRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := newPortPlumber(t, "")
+	if err := p.ParsePlumbingFile(fname, ""); err != nil {
+		t.Fatal(err)
+	}
+	cl := dial(t, p, "glenda")
+	if err := ctl(cl, "set editor=sam"); err != nil {
+		t.Fatal(err)
+	}
+	rules := "type is text\nplumb to image\n"
+	if err := os.WriteFile(fname, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl(cl, "reload"); err != nil {
+		t.Fatal(err)
+	}
+	if p.port("image") == nil || p.port("web") != nil {
+		t.Fatal("rules not reloaded")
+	}
+	if strings.Contains(settings(t, cl), "editor") {
+		t.Fatal("variable survived reload")
+	}
+}
@@ -0,0 +1,125 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultRules returns the default plumbing file ($HOME/lib/plumbing)
+func DefaultRules() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, "lib", "plumbing")
+}
+
+// environment variable with the file descriptor a detached plumber
+// reports its startup outcome on (see Ready)
+const readyEnv = "PLUMBER_READY_FD"
+
+// Detach starts the plumber as a background process with the same
+// arguments (running in the foreground) and returns its process id
+// once the background process is ready to serve clients; if it fails
+// to start, its startup error is returned. The output of the background
+// process is discarded; use a log file to keep it.
+func Detach() (int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	return detach(self, append([]string{"-f"}, os.Args[1:]...))
+}
+
+// detach starts a program in the background and waits for its startup
+// report.
+func detach(self string, args []string) (int, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	cmd := exec.Command(self, args...)
+	cmd.SysProcAttr = detachAttr()
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(os.Environ(), readyEnv+"=3")
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	// wait for the report (or the end) of the background process
+	report, _ := io.ReadAll(r)
+	status, msg, _ := strings.Cut(strings.TrimSpace(string(report)), " ")
+	if status == "ready" {
+		pid := cmd.Process.Pid
+		return pid, cmd.Process.Release()
+	}
+	if err = cmd.Wait(); status != "error" {
+		return 0, fmt.Errorf("background process failed (%v)", err)
+	}
+	return 0, errors.New(msg)
+}
+
+// report of the startup outcome (once)
+var readyOnce sync.Once
+
+// Ready reports the startup outcome of a plumber started by Detach to
+// the waiting parent process: nil if the plumber is ready to serve
+// clients, the error that stops it otherwise. Only the first report is
+// sent; without a waiting parent nothing happens.
+func Ready(err error) {
+	readyOnce.Do(func() {
+		fd, e := strconv.Atoi(os.Getenv(readyEnv))
+		if e != nil {
+			return
+		}
+		os.Unsetenv(readyEnv)
+		f := os.NewFile(uintptr(fd), "ready")
+		defer f.Close()
+		if err != nil {
+			fmt.Fprintf(f, "error %s\n", err)
+			return
+		}
+		f.WriteString("ready\n")
+	})
+}
+
+// WritePidfile writes the process id of the plumber to a file. The file
+// is not overwritten if it names another running plumber.
+func WritePidfile(fname string) error {
+	if buf, err := os.ReadFile(fname); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("plumber already running (pid %d)", pid)
+		}
+	}
+	return os.WriteFile(fname, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
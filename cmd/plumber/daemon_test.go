@@ -0,0 +1,93 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPidfile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "plumber.pid")
+	self := strconv.Itoa(os.Getpid()) + "\n"
+
+	// new and own pidfile
+	for range 2 {
+		if err := WritePidfile(fname); err != nil {
+			t.Fatal(err)
+		}
+		if buf, _ := os.ReadFile(fname); string(buf) != self {
+			t.Fatalf("pidfile content %q", buf)
+		}
+	}
+	// stale pidfile is replaced
+	if err := os.WriteFile(fname, []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePidfile(fname); err != nil {
+		t.Fatal(err)
+	}
+	// pidfile of a running process is kept
+	if err := os.WriteFile(fname, []byte(strconv.Itoa(os.Getppid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePidfile(fname); err == nil {
+		t.Fatal("pidfile of running process overwritten")
+	}
+}
+
+func TestDetach(t *testing.T) {
+	args := []string{"-test.run=^TestDetachHelper$"}
+	for _, mode := range []string{"ready", "error", "crash"} {
+		t.Setenv("PLUMBER_TEST_DETACH", mode)
+		pid, err := detach(os.Args[0], args)
+		switch mode {
+		case "ready":
+			if err != nil || pid == 0 {
+				t.Fatalf("ready: pid %d, error '%v'", pid, err)
+			}
+		case "error":
+			if err == nil || err.Error() != "port in use" {
+				t.Fatalf("error: got '%v'", err)
+			}
+		case "crash":
+			if err == nil {
+				t.Fatal("crash: no error")
+			}
+		}
+	}
+}
+
+// TestDetachHelper is run as background process by TestDetach
+func TestDetachHelper(t *testing.T) {
+	switch os.Getenv("PLUMBER_TEST_DETACH") {
+	case "ready":
+		Ready(nil)
+	case "error":
+		Ready(errors.New("port in use"))
+		os.Exit(1)
+	case "crash":
+		os.Exit(3)
+	}
+}
@@ -0,0 +1,166 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// TestFile ('/mnt/plumb/test') evaluates messages without side effects:
+// a client writes a message and reads back the outcome of its evaluation
+// against the active rules (like a snoop entry). No message is posted
+// and no program is started.
+type TestFile struct {
+	fs.BaseFile
+
+	input  map[uint64][]byte // fid-mapped message written
+	output map[uint64][]byte // fid-mapped unread outcome (after first read)
+	plmb   *Plumber          // reference to plumber instance
+}
+
+// NewTestFile creates a new file for dry-run evaluations
+func NewTestFile(s *proto.Stat, plmb *Plumber) *TestFile {
+	return &TestFile{
+		BaseFile: *fs.NewBaseFile(s),
+		input:    make(map[uint64][]byte),
+		output:   make(map[uint64][]byte),
+		plmb:     plmb,
+	}
+}
+
+// Open test file
+func (f *TestFile) Open(fid uint64, omode proto.Mode) error {
+	f.Lock()
+	defer f.Unlock()
+	f.input[fid] = []byte{}
+	return nil
+}
+
+// Write a message; offsets are ignored. A write after the outcome was
+// read starts a new message.
+func (f *TestFile) Write(fid uint64, ofs uint64, buf []byte) (uint32, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.output[fid]; ok {
+		delete(f.output, fid)
+		f.input[fid] = []byte{}
+	}
+	f.input[fid] = append(f.input[fid], buf...)
+	return uint32(len(buf)), nil
+}
+
+// Read the outcome of the evaluation of the message written; offsets are
+// ignored. The message is evaluated on the first read.
+func (f *TestFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	data, ok := f.output[fid]
+	if !ok {
+		msg, err := f.parse(f.input[fid])
+		if err != nil {
+			return nil, err
+		}
+		if f.plmb.Access.Stamp {
+			msg.Src = f.plmb.server.User(fid)
+		}
+		data = f.plmb.Plan(msg)
+	}
+	n := min(count, uint64(len(data)))
+	f.output[fid] = data[n:]
+	return data[:n], nil
+}
+
+// parse the message written (in the format of the send file)
+func (f *TestFile) parse(data []byte) (*lib.Message, error) {
+	if !f.plmb.Compat {
+		msg, err := lib.ParseMessage(string(data))
+		if err != nil {
+			return nil, ErrBadMsg
+		}
+		return msg, nil
+	}
+	msg, _, err := lib.UnpackMessage(data)
+	switch {
+	case err != nil:
+		return nil, ErrBadMsg
+	case msg == nil:
+		return nil, ErrIncomplete
+	}
+	return msg, nil
+}
+
+// Close test file
+func (f *TestFile) Close(fid uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.input, fid)
+	delete(f.output, fid)
+	return nil
+}
+
+//----------------------------------------------------------------------
+
+// Plan evaluates a message against the active rules like Dispatch, but
+// without side effects: 'plumb' actions are only recorded. A message is
+// considered delivered to a port that would take it. Returns the outcome
+// as entry like on the snoop file.
+func (p *Plumber) Plan(msg *lib.Message) []byte {
+	rec := newRecord("test")
+	out, ref, err := p.Simulate(msg, rec.worker(p.planWorker))
+	done := out != nil
+	if err == nil && !done && len(msg.Dst) > 0 {
+		if p.port(msg.Dst) == nil {
+			err = ErrNoPort
+		} else {
+			done = p.accepts(msg.Dst)
+			rec.action("to", msg.Dst, true, done)
+		}
+	}
+	if out == nil {
+		out = msg
+	}
+	return rec.entry(p, out, ref, done, err)
+}
+
+// planWorker returns a 'plumb' action that does nothing
+func (p *Plumber) planWorker() lib.Action {
+	return func(msg *lib.Message, verb, data string) (ok, done bool) {
+		switch verb {
+		case "to":
+			return true, p.accepts(data)
+		case "client", "start":
+			return true, true
+		}
+		return
+	}
+}
+
+// accepts returns true if a message posted on the named port now would
+// be taken (by a reader or the mailbox of the port).
+func (p *Plumber) accepts(name string) bool {
+	f := p.port(name)
+	if f == nil {
+		return p.dynamicAllowed(name) && p.PortCfg.Get(name).Mailbox > 0
+	}
+	return f.Accepts()
+}
@@ -0,0 +1,86 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// evaluate writes a message to the test file and reads the outcome
+func evaluate(f *client.File, msg []byte) (string, error) {
+	if _, err := f.Write(msg); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func TestDryRun(t *testing.T) {
+	rules := testRules + "\ntype is text\ndata matches 'img:(.*)'\nplumb to image\nplumb start page $1\n"
+	p := newTestPlumber(t, rules, true)
+	reader := openPorts(t, p, "edit", 1)[0]
+	f, err := dial(t, p, "glenda").Open("test", proto.Ordwr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, tc := range []struct {
+		data  string
+		lines []string
+	}{
+		{"main.go", []string{"ruleset 0\n", "action to edit -> ok=true, done=true\n", "delivered true\n"}},
+		{"https://9p.io/", []string{"ruleset none\n", "action to web -> ok=true, done=false\n", "delivered false\n"}},
+		{"img:glenda.png", []string{"ruleset 2\n", "action to image -> ok=true, done=false\n", "action start page glenda.png -> ok=true, done=true\n"}},
+	} {
+		msg := lib.NewMessage("plumb", "", "/", "text", tc.data)
+		got, err := evaluate(f, msg.Pack())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, "test ") {
+			t.Fatalf("%s: unexpected outcome %q", tc.data, got)
+		}
+		for _, line := range tc.lines {
+			if !strings.Contains(got, line) {
+				t.Fatalf("%s: missing %q in outcome %q", tc.data, line, got)
+			}
+		}
+	}
+	// nothing was delivered
+	msg := lib.NewMessage("plumb", "", "/", "text", "real.go")
+	if err = plumb(dial(t, p, "glenda"), msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	if got := await(t, readAsync(reader, 8192)); got != string(msg.Pack()) {
+		t.Fatalf("got %q", got)
+	}
+	// invalid messages fail
+	if _, err = evaluate(f, []byte("plumb\n\n/\ntext\n\n-1\n")); err == nil {
+		t.Fatal("invalid message evaluated")
+	}
+}
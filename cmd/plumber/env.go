@@ -0,0 +1,137 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// EnvFile ('/mnt/plumb/env') exposes the variables of the active rules
+// as 'name = value' lines. Lines written to the file set variables
+// immediately (without reparsing the rules); a line with an empty value
+// removes a variable. The text of the rules (and the plumbing file) is
+// not changed, so variables set this way are lost on reload.
+type EnvFile struct {
+	fs.BaseFile
+
+	content map[uint64][]byte // fid-mapped variables (on open)
+	partial map[uint64][]byte // fid-mapped incomplete lines written
+	plmb    *Plumber          // reference to plumber instance
+}
+
+// NewEnvFile creates a new environment file
+func NewEnvFile(s *proto.Stat, plmb *Plumber) *EnvFile {
+	return &EnvFile{
+		BaseFile: *fs.NewBaseFile(s),
+		content:  make(map[uint64][]byte),
+		partial:  make(map[uint64][]byte),
+		plmb:     plmb,
+	}
+}
+
+// Open environment file
+func (f *EnvFile) Open(fid uint64, omode proto.Mode) error {
+	f.Lock()
+	defer f.Unlock()
+	f.content[fid] = formatEnv(f.plmb.Env())
+	return nil
+}
+
+// Read variables (as of opening the file)
+func (f *EnvFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	data := f.content[fid]
+	flen := uint64(len(data))
+	if ofs >= flen {
+		return []byte{}, nil
+	}
+	last := min(ofs+count, flen)
+	return data[ofs:last], nil
+}
+
+// Write variable settings; offsets are ignored. All complete lines of a
+// write are applied in a single change.
+func (f *EnvFile) Write(fid uint64, ofs uint64, buf []byte) (uint32, error) {
+	f.Lock()
+	data := append(f.partial[fid], buf...)
+	pos := bytes.LastIndexByte(data, '\n') + 1
+	f.partial[fid] = data[pos:]
+	f.Unlock()
+
+	if err := f.apply(data[:pos]); err != nil {
+		return 0, err
+	}
+	return uint32(len(buf)), nil
+}
+
+// Close environment file: a pending incomplete line is applied.
+func (f *EnvFile) Close(fid uint64) error {
+	f.Lock()
+	data := f.partial[fid]
+	delete(f.partial, fid)
+	delete(f.content, fid)
+	f.Unlock()
+	return f.apply(data)
+}
+
+// apply variable settings
+func (f *EnvFile) apply(data []byte) error {
+	vars, err := parseEnv(string(data))
+	if err != nil || len(vars) == 0 {
+		return err
+	}
+	return f.plmb.UpdateEnv(vars)
+}
+
+// parseEnv parses 'name = value' lines. Empty lines and comments are
+// ignored.
+func parseEnv(s string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for line := range strings.SplitSeq(s, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid setting '%s'", line)
+		}
+		vars[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return vars, nil
+}
+
+// formatEnv returns variables as sorted 'name = value' lines
+func formatEnv(env map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		fmt.Fprintf(buf, "%s = %s\n", key, env[key])
+	}
+	return buf.Bytes()
+}
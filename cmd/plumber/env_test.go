@@ -0,0 +1,102 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// writeEnv writes chunks to the environment file
+func writeEnv(cl *client.Client, chunks ...string) error {
+	f, err := cl.Open("env", proto.Owrite)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err = f.Write([]byte(chunk)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// readEnv reads the environment file
+func readEnv(t *testing.T, cl *client.Client) string {
+	t.Helper()
+	f, err := cl.Open("env", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestEnvFile(t *testing.T) {
+	rules := "editor = acme\n\ntype is text\ndata matches '.*\\.go'\nplumb to $editor\n"
+	p := newTestPlumber(t, rules, true)
+	cl := dial(t, p, "glenda")
+	if got := readEnv(t, cl); got != "editor = acme\n" {
+		t.Fatalf("env: %q", got)
+	}
+	// variables are set immediately; lines can span writes
+	if err := writeEnv(cl, "editor = sam\nbrow", "ser = mothra\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readEnv(t, cl); got != "browser = mothra\neditor = sam\n" {
+		t.Fatalf("env: %q", got)
+	}
+	if p.port("sam") == nil || p.port("acme") != nil {
+		t.Fatal("ports not updated")
+	}
+	// an empty value removes a variable
+	if err := writeEnv(cl, "browser =\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readEnv(t, cl); got != "editor = sam\n" {
+		t.Fatalf("env: %q", got)
+	}
+	for _, bad := range []string{"bogus\n", "a b = c\n", "= x\n"} {
+		if writeEnv(cl, bad) == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	// the text of the rules is not changed
+	if string(p.File()) != rules {
+		t.Fatalf("rules changed: %q", p.File())
+	}
+	// others can read but not write the variables
+	other := dial(t, p, "alice")
+	if got := readEnv(t, other); got != "editor = sam\n" {
+		t.Fatalf("env: %q", got)
+	}
+	if writeEnv(other, "editor = acme\n") == nil {
+		t.Fatal("env written by other user")
+	}
+}
@@ -0,0 +1,362 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// DefaultHistory is the default number of messages kept in the history
+const DefaultHistory = 100
+
+// History is a bounded record of received messages and the outcome of
+// their evaluation. If the history is backed by a file, every record is
+// appended to the file and the history survives restarts; the file is
+// compacted to the kept records when it holds twice as many records.
+type History struct {
+	sync.Mutex
+
+	size    int           // max. number of records
+	records []*histRecord // records (oldest first)
+	last    uint64        // identifier of the last record
+	fname   string        // name of the history file
+	file    *os.File      // history file (or nil)
+	written int           // number of records in the history file
+	failed  bool          // writing the history file failed
+}
+
+// histRecord is a received message with the outcome of its evaluation
+type histRecord struct {
+	id    uint64       // identifier of the record
+	stamp time.Time    // time the message was received
+	msg   *lib.Message // received message
+	ref   lib.Ref      // matching ruleset
+	done  bool         // message delivered
+	err   string       // evaluation error (if any)
+}
+
+// NewHistory creates an in-memory history for up to size messages
+func NewHistory(size int) *History {
+	return &History{size: size}
+}
+
+// OpenHistory creates a history for up to size messages backed by a
+// file. Records in an existing file are loaded (the file is shortened
+// to the last size records).
+func OpenHistory(fname string, size int) (*History, error) {
+	h := NewHistory(size)
+	h.fname = fname
+	f, err := os.Open(fname)
+	switch {
+	case err == nil:
+		err = h.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fname, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	if err = h.compact(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// compact rewrites the history file with the kept records and reopens
+// it for appending. Must be called with the history locked.
+func (h *History) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(h.fname), ".history")
+	if err != nil {
+		return err
+	}
+	for _, r := range h.records {
+		tmp.Write(r.format(r.msg.Pack()))
+	}
+	if err = tmp.Close(); err == nil {
+		err = os.Rename(tmp.Name(), h.fname)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if h.file != nil {
+		h.file.Close()
+	}
+	if h.file, err = os.OpenFile(h.fname, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	h.written = len(h.records)
+	return nil
+}
+
+// Record a received message with the outcome of its evaluation
+func (h *History) Record(msg *lib.Message, ref lib.Ref, done bool, err error) {
+	if h == nil || h.size <= 0 {
+		return
+	}
+	r := &histRecord{
+		stamp: time.Now(),
+		msg:   msg.Clone(),
+		ref:   ref,
+		done:  done,
+	}
+	if err != nil {
+		r.err = err.Error()
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.last++
+	r.id = h.last
+	h.add(r)
+	if h.file == nil {
+		return
+	}
+	_, err = h.file.Write(r.format(r.msg.Pack()))
+	if h.written++; err == nil && h.written >= 2*h.size {
+		err = h.compact()
+	}
+	if err != nil && !h.failed {
+		slog.Error("can't write history file", "error", err)
+		h.failed = true
+	}
+}
+
+// add a record and drop the oldest records if the history is full. Must
+// be called with the history locked.
+func (h *History) add(r *histRecord) {
+	h.records = append(h.records, r)
+	if n := len(h.records) - h.size; n > 0 {
+		h.records = h.records[n:]
+	}
+}
+
+// Message returns the message of a record (or nil if the record is
+// no longer in the history)
+func (h *History) Message(id uint64) *lib.Message {
+	if h == nil {
+		return nil
+	}
+	h.Lock()
+	defer h.Unlock()
+	for _, r := range h.records {
+		if r.id == id {
+			return r.msg.Clone()
+		}
+	}
+	return nil
+}
+
+// Dump returns the records of the history (oldest first) with messages
+// packed by the plumber.
+func (h *History) Dump(p *Plumber) []byte {
+	buf := new(bytes.Buffer)
+	if h == nil {
+		return buf.Bytes()
+	}
+	h.Lock()
+	defer h.Unlock()
+	for _, r := range h.records {
+		buf.Write(r.format(p.Pack(r.msg)))
+	}
+	return buf.Bytes()
+}
+
+// Close the history file
+func (h *History) Close() error {
+	if h == nil || h.file == nil {
+		return nil
+	}
+	h.Lock()
+	defer h.Unlock()
+	return h.file.Close()
+}
+
+// format a record: a header with identifier and time, the matching
+// ruleset and the outcome followed by the (packed) message.
+func (r *histRecord) format(data []byte) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "history %d %s\n", r.id, r.stamp.Format(time.RFC3339Nano))
+	switch {
+	case r.ref.Index < 0:
+		buf.WriteString("ruleset none\n")
+	case len(r.ref.Name) > 0:
+		fmt.Fprintf(buf, "ruleset %d %s\n", r.ref.Index, r.ref.Name)
+	default:
+		fmt.Fprintf(buf, "ruleset %d\n", r.ref.Index)
+	}
+	fmt.Fprintf(buf, "delivered %v\n", r.done)
+	if len(r.err) > 0 {
+		fmt.Fprintf(buf, "error %s\n", strconv.Quote(r.err))
+	}
+	fmt.Fprintf(buf, "message %d\n", len(data))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// load records from a history file (with messages in plumb(6) format)
+func (h *History) load(in io.Reader) error {
+	rdr := bufio.NewReader(in)
+	var r *histRecord
+	for {
+		line, err := rdr.ReadString('\n')
+		if err == io.EOF && len(line) == 0 {
+			if r != nil {
+				return errors.New("truncated history record")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key, val, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		if key != "history" && r == nil {
+			return fmt.Errorf("invalid history line '%s'", line)
+		}
+		switch key {
+		case "history":
+			if r != nil {
+				return errors.New("truncated history record")
+			}
+			r = &histRecord{ref: lib.Ref{Index: -1}}
+			id, stamp, _ := strings.Cut(val, " ")
+			if r.id, err = strconv.ParseUint(id, 10, 64); err == nil {
+				r.stamp, err = time.Parse(time.RFC3339Nano, stamp)
+			}
+		case "ruleset":
+			if val != "none" {
+				idx, name, _ := strings.Cut(val, " ")
+				r.ref.Name = name
+				r.ref.Index, err = strconv.Atoi(idx)
+			}
+		case "delivered":
+			r.done, err = strconv.ParseBool(val)
+		case "error":
+			r.err, err = strconv.Unquote(val)
+		case "message":
+			var n int
+			if n, err = strconv.Atoi(val); err != nil {
+				break
+			}
+			data := make([]byte, n)
+			if _, err = io.ReadFull(rdr, data); err != nil {
+				break
+			}
+			if r.msg, _, err = lib.UnpackMessage(data); err == nil && r.msg == nil {
+				err = errors.New("incomplete message")
+			}
+			if err == nil {
+				h.add(r)
+				h.last = max(h.last, r.id)
+				r = nil
+			}
+		default:
+			err = fmt.Errorf("invalid history line '%s'", line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//----------------------------------------------------------------------
+
+// HistoryFile ('/mnt/plumb/history') is a read-only file listing the
+// records of the message history (as of opening the file).
+type HistoryFile struct {
+	fs.BaseFile
+
+	content map[uint64][]byte // fid-mapped records (on open)
+	plmb    *Plumber          // reference to plumber instance
+}
+
+// NewHistoryFile creates a new history file
+func NewHistoryFile(s *proto.Stat, plmb *Plumber) *HistoryFile {
+	return &HistoryFile{
+		BaseFile: *fs.NewBaseFile(s),
+		content:  make(map[uint64][]byte),
+		plmb:     plmb,
+	}
+}
+
+// Open history file for reading
+func (f *HistoryFile) Open(fid uint64, omode proto.Mode) error {
+	if omode&3 != proto.Oread {
+		return ErrPerm
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.content[fid] = f.plmb.History.Dump(f.plmb)
+	return nil
+}
+
+// Read records (as of opening the file)
+func (f *HistoryFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	data := f.content[fid]
+	flen := uint64(len(data))
+	if ofs >= flen {
+		return []byte{}, nil
+	}
+	last := min(ofs+count, flen)
+	return data[ofs:last], nil
+}
+
+// Close history file
+func (f *HistoryFile) Close(fid uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.content, fid)
+	return nil
+}
+
+//----------------------------------------------------------------------
+
+// Replay a message of the history: the message is dispatched again
+// against the active rules (and recorded as new message).
+func (p *Plumber) Replay(id uint64) error {
+	msg := p.History.Message(id)
+	if msg == nil {
+		return fmt.Errorf("no message %d in history", id)
+	}
+	slog.Info("replaying message", "id", id)
+	done, err := p.Dispatch(msg)
+	if err == nil && !done {
+		err = ErrNoRule
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/proto"
+)
+
+func TestHistory(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	reader := openPorts(t, p, "edit", 1)[0]
+	cl := dial(t, p, "glenda")
+
+	// delivered and undelivered messages are recorded
+	msg1 := lib.NewMessage("plumb", "", "/", "text", "main.go")
+	msg2 := lib.NewMessage("plumb", "", "/", "text", "nothing")
+	res := readAsync(reader, 8192)
+	if err := plumb(cl, msg1.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	await(t, res)
+	plumb(cl, msg2.Pack())
+
+	f, err := cl.Open("history", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := strings.Split(string(data), "history ")[1:]
+	if len(entries) != 2 {
+		t.Fatalf("history: %q", data)
+	}
+	for i, lines := range [][]string{
+		{"1 ", "ruleset 0\n", "delivered true\n", "message 24\n" + string(msg1.Pack())},
+		{"2 ", "ruleset none\n", "delivered false\n", "message 24\n" + string(msg2.Pack())},
+	} {
+		for _, line := range lines {
+			if !strings.Contains(entries[i], line) {
+				t.Fatalf("missing %q in record %q", line, entries[i])
+			}
+		}
+	}
+	// a recorded message is dispatched again
+	res = readAsync(reader, 8192)
+	if err = ctl(cl, "replay 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := await(t, res); got != string(msg1.Pack()) {
+		t.Fatalf("replayed: got %q", got)
+	}
+	if ctl(cl, "replay 2") == nil || ctl(cl, "replay 42") == nil {
+		t.Fatal("replay failure not reported")
+	}
+	// only the owner can read the history
+	if _, err = dial(t, p, "alice").Open("history", proto.Oread); err == nil {
+		t.Fatal("history opened by other user")
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "history")
+	h, err := OpenHistory(fname, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a.go", "b.go", "c.go"} {
+		h.Record(lib.NewMessage("plumb", "", "/", "text", data), lib.Ref{Index: 0, Name: "go"}, true, nil)
+	}
+	if h.Message(1) != nil {
+		t.Fatal("oldest message kept")
+	}
+	h.Close()
+
+	// the last records are loaded from the file
+	if h, err = OpenHistory(fname, 2); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if msg := h.Message(3); msg == nil || msg.Data != "c.go" {
+		t.Fatalf("record 3: %v", msg)
+	}
+	if h.records[0].ref.Name != "go" || !h.records[0].done {
+		t.Fatalf("record 2: %+v", h.records[0])
+	}
+	h.Record(lib.NewMessage("plumb", "", "/", "text", "d.go"), lib.Ref{Index: -1}, false, ErrNoRule)
+	if msg := h.Message(4); msg == nil || msg.Data != "d.go" {
+		t.Fatalf("record 4: %v", msg)
+	}
+	// the file holds the kept and the new records
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "history "); n != 3 {
+		t.Fatalf("%d records in file", n)
+	}
+	// the file is compacted when it holds twice the records
+	h.Record(lib.NewMessage("plumb", "", "/", "text", "e.go"), lib.Ref{Index: -1}, false, errors.New("line 1\nline 2"))
+	if data, err = os.ReadFile(fname); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "history "); n != 2 {
+		t.Fatalf("%d records in compacted file", n)
+	}
+	h.Record(lib.NewMessage("plumb", "", "/", "text", "f.go"), lib.Ref{Index: -1}, false, nil)
+	h.Close()
+
+	// errors with line breaks survive a restart
+	if h, err = OpenHistory(fname, 2); err != nil {
+		t.Fatal(err)
+	}
+	if h.records[0].err != "line 1\nline 2" || h.records[1].msg.Data != "f.go" {
+		t.Fatalf("records %+v, %+v", h.records[0], h.records[1])
+	}
+	h.Close()
+	if os.WriteFile(fname, []byte("bogus\n"), 0600) != nil {
+		t.Fatal("can't write history file")
+	}
+	if _, err = OpenHistory(fname, 2); err == nil {
+		t.Fatal("invalid history file loaded")
+	}
+}
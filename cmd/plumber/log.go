@@ -0,0 +1,123 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// additional log levels (above ERROR)
+const (
+	LevelSevere   = slog.LevelError + 4
+	LevelCritical = slog.LevelError + 8
+)
+
+// logLevels are the names of the log levels
+var logLevels = map[string]slog.Level{
+	"CRITICAL": LevelCritical,
+	"SEVERE":   LevelSevere,
+	"ERROR":    slog.LevelError,
+	"WARN":     slog.LevelWarn,
+	"INFO":     slog.LevelInfo,
+	"DBG":      slog.LevelDebug,
+}
+
+// logLevel is the current log level (shared by all handlers)
+var logLevel = new(slog.LevelVar)
+
+// SetLogLevel sets the log level by name ("CRITICAL", "SEVERE", "ERROR",
+// "WARN", "INFO" or "DBG").
+func SetLogLevel(name string) error {
+	level, ok := logLevels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level '%s'", name)
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+// LogLevel returns the name of the current log level
+func LogLevel() string {
+	return levelName(logLevel.Level())
+}
+
+// levelName returns the name of a log level
+func levelName(level slog.Level) string {
+	for name, l := range logLevels {
+		if l == level {
+			return name
+		}
+	}
+	return level.String()
+}
+
+// SetupLogging sets log level, format and output of the default logger
+// (standard output if no file is given). Allowed formats are "plain"
+// (key=value pairs) and "json" (one object per line).
+func SetupLogging(level, format, fname string) error {
+	if err := SetLogLevel(level); err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if len(fname) > 0 {
+		f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("can't log to '%s'", fname)
+		}
+		out = f
+	}
+	h, err := NewLogHandler(out, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// NewLogHandler returns a log handler for the given format that logs at
+// the current log level (see SetLogLevel).
+func NewLogHandler(out io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				a.Value = slog.StringValue(levelName(a.Value.Any().(slog.Level)))
+			}
+			return a
+		},
+	}
+	switch format {
+	case "plain":
+		return slog.NewTextHandler(out, opts), nil
+	case "json":
+		return slog.NewJSONHandler(out, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format '%s'", format)
+}
+
+// logCritical logs a message at CRITICAL level with the default logger
+func logCritical(msg string, args ...any) {
+	slog.Log(context.Background(), LevelCritical, msg, args...)
+}
@@ -0,0 +1,115 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bfix/plumber/lib"
+)
+
+func TestSetupLogging(t *testing.T) {
+	logger, level := slog.Default(), LogLevel()
+	t.Cleanup(func() {
+		slog.SetDefault(logger)
+		SetLogLevel(level)
+	})
+	if err := SetupLogging("LOUD", "plain", ""); err == nil {
+		t.Fatal("invalid log level accepted")
+	}
+	if err := SetupLogging("DBG", "color", ""); err == nil {
+		t.Fatal("invalid log format accepted")
+	}
+	fname := filepath.Join(t.TempDir(), "plumber.log")
+	if err := SetupLogging("WARN", "json", fname); err != nil {
+		t.Fatal(err)
+	}
+	// records below the log level are dropped
+	slog.Info("ignored")
+	slog.Warn("port removed", "port", "edit")
+	logCritical("service failed")
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("log: %q", data)
+	}
+	var rec map[string]any
+	if err = json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["level"] != "WARN" || rec["msg"] != "port removed" || rec["port"] != "edit" {
+		t.Fatalf("record %v", rec)
+	}
+	if err = json.Unmarshal([]byte(lines[1]), &rec); err != nil || rec["level"] != "CRITICAL" {
+		t.Fatalf("record %v (%v)", rec, err)
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	logger, level := slog.Default(), LogLevel()
+	t.Cleanup(func() {
+		slog.SetDefault(logger)
+		SetLogLevel(level)
+	})
+	fname := filepath.Join(t.TempDir(), "plumber.log")
+	if err := SetupLogging("DBG", "json", fname); err != nil {
+		t.Fatal(err)
+	}
+	// the logger is injected into the plumbing library
+	p := newTestPlumber(t, testRules, true)
+	if _, err := p.Dispatch(lib.NewMessage("plumb", "", "/", "text", "main.go")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plumb, rule bool
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec struct {
+			Msg     string            `json:"msg"`
+			Message map[string]string `json:"message"`
+			Ruleset string            `json:"ruleset"`
+			Verb    string            `json:"verb"`
+		}
+		if err = json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		switch rec.Msg {
+		case "plumb":
+			plumb = rec.Message["src"] == "plumb" && rec.Message["type"] == "text" && rec.Verb == "to"
+		case "rule":
+			rule = rule || (rec.Ruleset == "0" && rec.Message["src"] == "plumb")
+		}
+	}
+	if !plumb || !rule {
+		t.Fatalf("missing fields in log: %s", data)
+	}
+}
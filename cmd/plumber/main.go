@@ -21,35 +21,135 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"log/slog"
 	"os"
-
-	"github.com/bfix/gospel/logger"
+	"regexp"
+	"runtime"
+	"time"
 )
 
+// exit with error message on startup failures
+func fatal(msg string) {
+	Ready(errors.New(msg))
+	fmt.Fprintln(os.Stderr, "plumber: "+msg)
+	os.Exit(1)
+}
+
 func main() {
 	// handle command-line options
-	flag.Bool("f", false, "run in foreground")
-	rules := flag.String("p", "", "plumbing file")
+	fg := flag.Bool("f", false, "run in foreground")
+	rules := flag.String("p", "", "plumbing file (default "+DefaultRules()+")")
+	dry := flag.Bool("n", false, "dry run: log actions without executing them")
+	logLevel := flag.String("loglevel", "INFO", "log level (CRITICAL, SEVERE, ERROR, WARN, INFO, DBG)")
+	logFormat := flag.String("logformat", "plain", "log format (plain, json)")
+	logFile := flag.String("log", "", "log file (default: standard output)")
+	pidfile := flag.String("pidfile", "", "write process id to file")
+	compat := flag.Bool("compat", false, "plan9port compatibility mode")
+	addr := flag.String("addr", "127.0.0.1:3124", "TCP listen address (empty to disable)")
+	tlsAddr := flag.String("tls", "", "TLS listen address for remote access")
+	tlsCert := flag.String("cert", "", "TLS server certificate (PEM)")
+	tlsKey := flag.String("key", "", "TLS server key (PEM)")
+	tlsUsers := flag.String("users", "", "allowed client certificates (fingerprint and user per line)")
+	acl := flag.String("acl", "", "access rules for the plumber files")
+	portCfg := flag.String("ports", "", "port configuration (delivery modes)")
+	dynPorts := flag.String("dynports", "", "pattern for names of ports created on demand (default: any name)")
+	watch := flag.Duration("watch", 0, "poll interval for changes of the plumbing file (0 to disable)")
+	grace := flag.Duration("grace", 5*time.Second, "grace period for evaluations and programs on shutdown")
+	terminate := flag.Bool("terminate", false, "terminate started programs on shutdown")
+	history := flag.Int("history", DefaultHistory, "number of received messages kept in the history (0 to disable)")
+	histFile := flag.String("histfile", "", "file for the message history (default: history in memory)")
+	metrics := flag.String("metrics", "", "HTTP listen address for metrics in Prometheus format (empty to disable)")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of workers evaluating messages (0: evaluate on receipt)")
+	queue := flag.Int("queue", DefaultQueue, "max. number of messages queued for evaluation")
 	flag.Parse()
 
-	// TODO: use default plumbing file if no file is specified
+	// run in background: start a detached copy of ourself and report
+	// its process id.
+	if !*fg {
+		if err := SetupLogging(*logLevel, *logFormat, ""); err != nil {
+			fatal(err.Error())
+		}
+		pid, err := Detach()
+		if err != nil {
+			fatal("can't start in background: " + err.Error())
+		}
+		fmt.Println(pid)
+		return
+	}
 
 	// setup logging
-	logger.SetLogLevelFromName("DBG")
-	logger.UseFormat(logger.ColorFormat)
+	if err := SetupLogging(*logLevel, *logFormat, *logFile); err != nil {
+		fatal(err.Error())
+	}
+	if len(*pidfile) > 0 {
+		if err := WritePidfile(*pidfile); err != nil {
+			fatal("can't write pidfile: " + err.Error())
+		}
+	}
 
 	// prepare plumber
 	plmb := NewPlumber()
+	plmb.Dry.Store(*dry)
+	plmb.Compat = *compat
+	if *compat {
+		plmb.PortCfg = NewPortConfigs(true)
+	}
+	plmb.Addr = *addr
+	plmb.Watch = *watch
+	plmb.Grace = *grace
+	plmb.Terminate = *terminate
+	plmb.Metrics = *metrics
+	plmb.Workers = *workers
+	plmb.Queue = *queue
+	if len(*acl) > 0 {
+		var err error
+		if plmb.Access, err = ReadAccess(*acl); err != nil {
+			fatal("can't read access rules: " + err.Error())
+		}
+	}
+	if len(*portCfg) > 0 {
+		var err error
+		if plmb.PortCfg, err = ReadPortConfigs(*portCfg, *compat); err != nil {
+			fatal("can't read port configuration: " + err.Error())
+		}
+	}
+	if len(*dynPorts) > 0 {
+		var err error
+		if plmb.DynPort, err = regexp.Compile("^(?:" + *dynPorts + ")$"); err != nil {
+			fatal("invalid pattern for dynamic ports: " + err.Error())
+		}
+	}
+	if len(*histFile) > 0 && *history > 0 {
+		var err error
+		if plmb.History, err = OpenHistory(*histFile, *history); err != nil {
+			fatal("can't open history file: " + err.Error())
+		}
+	} else {
+		plmb.History = NewHistory(*history)
+	}
+	if len(*tlsAddr) > 0 {
+		var err error
+		if plmb.Remote, err = NewTLSService(*tlsAddr, *tlsCert, *tlsKey, *tlsUsers); err != nil {
+			fatal("can't set up TLS service: " + err.Error())
+		}
+	}
 
-	// load rules file
-	home, _ := os.UserHomeDir()
-	fallback := home + "/lib/plumbing"
-	if err := plmb.ParsePlumbingFile(*rules, fallback); err != nil {
-		logger.Println(logger.WARN, "no plumbing file loaded!")
+	// load rules file (the default plumbing file is used if the file
+	// can't be loaded)
+	if err := plmb.ParsePlumbingFile(*rules, DefaultRules()); err != nil {
+		slog.Warn("no plumbing file loaded", "error", err)
+	} else {
+		slog.Info("plumbing file loaded", "file", plmb.Filename())
 	}
 
 	// build plumber namespace and post/start server
 	plmb.NamespaceService()
-	plmb.Run()
+	status := plmb.Run()
+	if len(*pidfile) > 0 {
+		os.Remove(*pidfile)
+	}
+	os.Exit(status)
 }
@@ -22,9 +22,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
 
-	"github.com/bfix/gospel/logger"
 	"github.com/bfix/plumber/lib"
 	"github.com/knusbaum/go9p/fs"
 	"github.com/knusbaum/go9p/proto"
@@ -32,6 +37,26 @@ import (
 
 //----------------------------------------------------------------------
 
+// Error messages returned to 9P clients (wording as in the plumber of
+// plan9port, see $PLAN9/src/cmd/plumb/fsys.c)
+var (
+	ErrPerm     = errors.New("permission denied")
+	ErrInUse    = errors.New("file already open")
+	ErrBadMsg   = errors.New("bad plumb message format")
+	ErrNoPort   = errors.New("no such plumb port")
+	ErrNoRule   = errors.New("no matching plumb rule")
+	ErrOffset   = errors.New("illegal offset")
+	ErrNotExist = errors.New("plumb file does not exist")
+	ErrIsDir    = errors.New("file is a directory")
+	ErrBadFid   = errors.New("unknown fid")
+	ErrExist    = errors.New("file already exists")
+	ErrIntr     = errors.New("interrupted")
+
+	ErrIncomplete = errors.New("incomplete plumb message")
+)
+
+//----------------------------------------------------------------------
+
 // RuleFile ('/mnt/plumb/rules')
 // - Writing new rules file
 // - Appending to rules file
@@ -39,29 +64,27 @@ import (
 type RulesFile struct {
 	fs.BaseFile
 
-	content   map[uint64][]byte // fid-mapped content
-	plmb      *Plumber          // reference to plumber instance
-	mode      proto.Mode        // open mode: read/write
-	syncPorts func()            // sync ports after rule changes
+	content map[uint64][]byte     // fid-mapped content
+	plmb    *Plumber              // reference to plumber instance
+	modes   map[uint64]proto.Mode // fid-mapped open modes
 }
 
 // NewRulesFile creates a new filesystem node for rules
-func NewRulesFile(s *proto.Stat, plmb *Plumber, sync func()) *RulesFile {
+func NewRulesFile(s *proto.Stat, plmb *Plumber) *RulesFile {
 	return &RulesFile{
-		BaseFile:  *fs.NewBaseFile(s),
-		content:   make(map[uint64][]byte),
-		plmb:      plmb,
-		syncPorts: sync,
+		BaseFile: *fs.NewBaseFile(s),
+		content:  make(map[uint64][]byte),
+		modes:    make(map[uint64]proto.Mode),
+		plmb:     plmb,
 	}
 }
 
-// Stat returns the current file stats
+// Stat returns the current file stats. The length is adjusted to the
+// content on every call; the stored stat is not changed, as requests
+// (and their stats) are served concurrently.
 func (f *RulesFile) Stat() proto.Stat {
 	s := f.BaseFile.Stat()
-	l := uint64(len(f.plmb.File()))
-	//logger.Printf(logger.DBG, "Stat{length: %d -> %d}", s.Length, l)
-	s.Length = l // adjust file size to content
-	f.WriteStat(&s)
+	s.Length = uint64(len(f.plmb.File()))
 	return s
 }
 
@@ -69,9 +92,9 @@ func (f *RulesFile) Stat() proto.Stat {
 func (f *RulesFile) Open(fid uint64, omode proto.Mode) error {
 	f.Lock()
 	defer f.Unlock()
-	//logger.Printf(logger.DBG, "Open{fid:%d,omode=%v}", fid, omode)
+	//slog.Debug("open", "file", f.Stat().Name, "fid", fid, "mode", omode)
 
-	f.mode = omode
+	f.modes[fid] = omode
 	f.content[fid] = f.plmb.File()
 	return nil
 }
@@ -80,7 +103,7 @@ func (f *RulesFile) Open(fid uint64, omode proto.Mode) error {
 func (f *RulesFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
 	f.RLock()
 	defer f.RUnlock()
-	//logger.Printf(logger.DBG, "Read{fid:%d,ofs:%d,cnt:%d}", fid, ofs, count)
+	//slog.Debug("read", "fid", fid, "offset", ofs, "count", count)
 
 	data := f.content[fid]
 	flen := uint64(len(data))
@@ -94,14 +117,14 @@ func (f *RulesFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
 
 // Write data to file at given position
 func (f *RulesFile) Write(fid uint64, ofs uint64, buf []byte) (uint32, error) {
-	f.RLock()
-	defer f.RUnlock()
-	//logger.Printf(logger.DBG, "Write{fid:%d,ofs:%d,buf:[%d]}", fid, ofs, len(buf))
+	f.Lock()
+	defer f.Unlock()
+	//slog.Debug("write", "file", f.Stat().Name, "fid", fid, "offset", ofs, "count", len(buf))
 
 	data := f.content[fid]
 	flen := uint64(len(data))
 	if ofs > flen {
-		return 0, errors.New("illegal offset")
+		return 0, ErrOffset
 	}
 	f.content[fid] = append(data[:ofs], buf...)
 	return uint32(len(buf)), nil
@@ -109,17 +132,20 @@ func (f *RulesFile) Write(fid uint64, ofs uint64, buf []byte) (uint32, error) {
 
 // Close file and parse written content
 func (f *RulesFile) Close(fid uint64) (err error) {
-	//logger.Printf(logger.DBG, "Close{fid:%d}", fid)
-	switch f.mode {
+	//slog.Debug("close", "file", f.Stat().Name, "fid", fid)
+	f.Lock()
+	data, mode := f.content[fid], f.modes[fid]
+	delete(f.content, fid)
+	delete(f.modes, fid)
+	f.Unlock()
+
+	switch mode {
 	case proto.Oread:
 		// no action
 	case proto.Owrite:
-		data := f.content[fid]
 		rdr := bytes.NewBuffer(data)
 		err = f.plmb.ParsePlumbingFromRdr(rdr)
-		f.syncPorts()
 	}
-	delete(f.content, fid)
 	return
 }
 
@@ -147,146 +173,542 @@ func NewSendFile(s *proto.Stat, plmb *Plumber) *SendFile {
 func (f *SendFile) Open(fid uint64, omode proto.Mode) (err error) {
 	f.Lock()
 	defer f.Unlock()
-	logger.Printf(logger.DBG, "Open{fid:%d,omode=%v}", fid, omode)
+	slog.Debug("open", "file", f.Stat().Name, "fid", fid, "mode", omode)
 
 	if omode == proto.Owrite {
 		f.content[fid] = []byte{}
 	} else {
-		err = errors.New("permission denied")
+		err = ErrPerm
 	}
 	return
 }
 
 // Write data to file at given position
 func (f *SendFile) Write(fid uint64, ofs uint64, buf []byte) (uint32, error) {
-	f.RLock()
-	defer f.RUnlock()
-	logger.Printf(logger.DBG, "Write{fid:%d,ofs:%d,buf:[%d]}", fid, ofs, len(buf))
+	slog.Debug("write", "file", f.Stat().Name, "fid", fid, "offset", ofs, "count", len(buf))
+	if f.plmb.Compat {
+		return f.writeMsg(fid, buf)
+	}
+	f.Lock()
+	defer f.Unlock()
 
 	data := f.content[fid]
 	flen := uint64(len(data))
 	if ofs > flen {
-		logger.Printf(logger.WARN, "  write beyond eof: %d > %d", ofs, flen)
-		return 0, errors.New("illegal offset")
+		slog.Warn("write beyond eof", "file", f.Stat().Name, "offset", ofs, "length", flen)
+		return 0, ErrOffset
 	}
 	f.content[fid] = append(data[:ofs], buf...)
 	return uint32(len(buf)), nil
 }
 
-// Close file and process content (message)
-func (f *SendFile) Close(fid uint64) (err error) {
-	logger.Printf(logger.DBG, "Close{fid:%d}", fid)
+// writeMsg handles writes in plan9port compatibility mode: offsets are
+// ignored and a message is dispatched as soon as it is complete. Errors
+// during dispatch are returned to the writer.
+func (f *SendFile) writeMsg(fid uint64, buf []byte) (uint32, error) {
+	f.Lock()
+	data := append(f.content[fid], buf...)
+	msg, used, err := lib.UnpackMessage(data)
+	switch {
+	case err != nil:
+		f.content[fid] = []byte{}
+	case msg == nil:
+		// wait for more data
+		f.content[fid] = data
+	default:
+		f.content[fid] = data[used:]
+	}
+	f.Unlock()
 
-	data := f.content[fid]
-	var msg *lib.Message
-	msg, err = lib.ParseMessage(string(data))
-	if err == nil && msg != nil {
-		var done bool
-		if done, err = f.plmb.Process(msg); err == nil && !done && len(msg.Dst) > 0 {
-			f.plmb.FeedPort(msg.Dst, msg)
+	if msg != nil {
+		f.stamp(fid, msg)
+	}
+	if err != nil {
+		f.plmb.Reject(data, err)
+		return 0, ErrBadMsg
+	}
+	if msg != nil {
+		// plan9port clients expect the outcome on write
+		delivered, err := f.plmb.Send(sender(fid), msg)
+		if err != nil {
+			return 0, err
+		}
+		if !delivered {
+			return 0, ErrNoRule
 		}
-	} else {
-		logger.Println(logger.WARN, "received invalid message: "+err.Error())
 	}
+	return uint32(len(buf)), nil
+}
+
+// stamp the source of a message with the user name of the sender
+// (if required by the access rules)
+func (f *SendFile) stamp(fid uint64, msg *lib.Message) {
+	if f.plmb.Access.Stamp {
+		msg.Src = f.plmb.server.User(fid)
+	}
+}
+
+// sender returns the key of the sender of messages written on a fid:
+// messages sent on the same 9P connection are evaluated in order.
+func sender(fid uint64) string {
+	return strconv.FormatUint(uint64(connID(fid)), 10)
+}
+
+// Close file and evaluate the content (message)
+func (f *SendFile) Close(fid uint64) (err error) {
+	slog.Debug("close", "file", f.Stat().Name, "fid", fid)
+	f.Lock()
+	data := f.content[fid]
 	delete(f.content, fid)
+	f.Unlock()
+
+	if f.plmb.Compat {
+		// messages are dispatched on write
+		if len(data) > 0 {
+			f.plmb.Reject(data, ErrIncomplete)
+		}
+		return
+	}
+	var msg *lib.Message
+	if msg, err = lib.ParseMessage(string(data)); err != nil {
+		f.plmb.Reject(data, err)
+		return
+	}
+	if msg != nil {
+		f.stamp(fid, msg)
+		_, err = f.plmb.Send(sender(fid), msg)
+	}
 	return
 }
 
 //----------------------------------------------------------------------
 
 // PortFile ('/mnt/plumb/<portname>') is a read-only file where the plumber
-// publishes messages to a single reader.
+// publishes messages to its readers. Depending on the delivery mode of
+// the port there is a single reader, every reader gets every message
+// (broadcast) or each message goes to one reader (work-queue).
+// Messages are queued for each reader; the queues are bounded, so a
+// reader that does not read can't block the plumber.
+// In mailbox mode messages for a port without readers are held until
+// the port is opened. Messages nobody collected are posted on the
+// 'undelivered' port.
 type PortFile struct {
 	fs.BaseFile
 
-	skipped uint64      // fid-mapped skips
-	buf     []byte      // current content
-	pending bool        // pending message (don't clear on Open)
-	post    chan []byte // channel for posting messages
-	watched bool        // is someone reading this?
+	plmb    *Plumber               // reference to plumber instance
+	cfg     *PortConfig            // port configuration
+	readers map[uint64]*portReader // fid-mapped readers
+	order   []uint64               // readers in order of opening
+	next    int                    // next reader in work-queue mode
+	mailbox []heldMsg              // messages held for the next reader
+	expiry  *time.Timer            // timer for expiring held messages
+	dropped atomic.Uint64          // number of dropped messages
+	orphan  bool                   // port no longer referenced by rules
+	dynamic bool                   // port created on demand
+	creator uint64                 // fid of creator (ad-hoc port) or 0
+}
+
+// UndeliveredPort is the name of the port for messages nobody collected
+const UndeliveredPort = "undelivered"
+
+// heldMsg is a message held in the mailbox of a port
+type heldMsg struct {
+	msg   *lib.Message // held message
+	stamp time.Time    // time the message was held
+}
+
+// portReader is the state of a fid reading from a port
+type portReader struct {
+	lock  readLock  // serializes reads (guards buf and pos)
+	queue *msgQueue // queued messages
+	buf   []byte    // current message
+	pos   uint64    // read position in buf
+}
+
+// readLock serializes concurrent reads on a fid (requests are served
+// concurrently). It is held while a read waits for a message, so waiting
+// for the lock can be interrupted like the wait itself.
+type readLock chan struct{}
+
+// newReadLock returns an unlocked read lock
+func newReadLock() readLock {
+	return make(readLock, 1)
+}
+
+// Lock waits for the lock; returns ErrIntr if the context is cancelled.
+func (l readLock) Lock(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ErrIntr
+	}
+}
+
+// Unlock releases the lock
+func (l readLock) Unlock() {
+	<-l
 }
 
 // NewPortFile initializes a new port instance
-func NewPortFile(s *proto.Stat) *PortFile {
+func NewPortFile(s *proto.Stat, plmb *Plumber, cfg *PortConfig) *PortFile {
 	return &PortFile{
 		BaseFile: *fs.NewBaseFile(s),
-		skipped:  0,
-		buf:      []byte{},
-		pending:  false,
-		post:     make(chan []byte),
-		watched:  false,
+		plmb:     plmb,
+		cfg:      cfg,
+		readers:  make(map[uint64]*portReader),
 	}
 }
 
-// Post a message on the port (only if we have readers)
+// Readers returns the number of readers of the port
+func (f *PortFile) Readers() int {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.readers)
+}
+
+// Accepts returns true if the port would take a message now: it has
+// readers or holds messages for the next reader.
+func (f *PortFile) Accepts() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.readers) > 0 || (f.cfg.Mailbox > 0 && !f.orphan)
+}
+
+// Dropped returns the number of messages dropped on full queues
+func (f *PortFile) Dropped() uint64 {
+	return f.dropped.Load()
+}
+
+// Post a message on the port (only if we have readers or the port is in
+// mailbox mode). No messages are posted during shutdown. Deliveries are
+// counted in the statistics.
 func (f *PortFile) Post(msg *lib.Message) bool {
-	if !f.watched {
+	if !f.post(msg) {
 		return false
 	}
-	f.post <- []byte(msg.String())
+	f.plmb.Stats.Delivered(f.Stat().Name)
 	return true
 }
 
-// Keep a message for yet un-opened port file
-func (f *PortFile) Keep(msg *lib.Message) bool {
-	if f.watched {
+// post a message to the readers of the port (see Post)
+func (f *PortFile) post(msg *lib.Message) bool {
+	if f.cfg.Mailbox > 0 && f.hold(msg, f.cfg.Mailbox) {
+		return true
+	}
+	if f.cfg.Mode == PortQueue {
+		// the next reader with space in its queue takes the message; if
+		// all queues are full, the queue policy applies.
+		n := f.Readers()
+		for range n {
+			if r := f.nextReader(); r != nil && r.queue.Len() < f.cfg.Queue {
+				return f.deliver(r, msg)
+			}
+		}
+		if r := f.nextReader(); r != nil {
+			return f.deliver(r, msg)
+		}
 		return false
 	}
+	f.RLock()
+	list := make([]*portReader, 0, len(f.readers))
+	for _, fid := range f.order {
+		list = append(list, f.readers[fid])
+	}
+	f.RUnlock()
+
+	delivered := false
+	for _, r := range list {
+		if f.deliver(r, msg) {
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+// nextReader returns the next reader in round-robin order
+func (f *PortFile) nextReader() *portReader {
 	f.Lock()
 	defer f.Unlock()
+	if len(f.order) == 0 {
+		return nil
+	}
+	f.next %= len(f.order)
+	r := f.readers[f.order[f.next]]
+	f.next++
+	return r
+}
+
+// deliver a message to the queue of a reader; fails if the message was
+// dropped, the reader closed the port or on shutdown.
+func (f *PortFile) deliver(r *portReader, msg *lib.Message) bool {
+	ok, dropped := r.queue.Push(msg, f.cfg, f.plmb.life.Closing())
+	if dropped != nil {
+		f.dropped.Add(1)
+		slog.Warn("queue full, message dropped", "port", f.Stat().Name, "policy", f.cfg.Policy.String(), "message", dropped)
+		if dropped != msg {
+			f.undelivered(dropped)
+		}
+	}
+	return ok
+}
+
+// wait for the next message for a reader; returns nil on shutdown, if
+// the reader is closed or the port is orphaned (EOF) and ErrIntr if the
+// read is cancelled.
+func (f *PortFile) wait(ctx context.Context, r *portReader) ([]byte, error) {
+	msg := r.queue.Pop(f.plmb.life.Closing(), ctx.Done())
+	if msg == nil {
+		if ctx.Err() != nil {
+			return nil, ErrIntr
+		}
+		return nil, nil
+	}
+	return f.plmb.Pack(msg), nil
+}
+
+// undelivered passes messages nobody collected to the 'undelivered' port
+func (f *PortFile) undelivered(msgs ...*lib.Message) {
+	if f.Stat().Name == UndeliveredPort {
+		return
+	}
+	for _, msg := range msgs {
+		f.plmb.Undelivered(f.Stat().Name, msg)
+	}
+}
+
+// Keep a message for yet un-opened port file
+func (f *PortFile) Keep(msg *lib.Message) bool {
+	return f.hold(msg, max(f.cfg.Mailbox, 1))
+}
+
+// hold a message in the mailbox if the port has no readers. If the
+// mailbox is full, the oldest message is undelivered.
+func (f *PortFile) hold(msg *lib.Message, size int) bool {
+	f.Lock()
+	if len(f.readers) > 0 || f.orphan {
+		f.Unlock()
+		return false
+	}
+	expired := f.expire()
+	f.mailbox = append(f.mailbox, heldMsg{msg, time.Now()})
+	if n := len(f.mailbox) - size; n > 0 {
+		expired = append(expired, f.mailbox[:n]...)
+		f.mailbox = f.mailbox[n:]
+	}
+	if f.cfg.TTL > 0 && f.expiry == nil {
+		f.expiry = time.AfterFunc(f.cfg.TTL, f.sweep)
+	}
+	f.Unlock()
 
-	f.buf = []byte(msg.String())
-	f.pending = true
+	f.undelivered(heldMsgs(expired)...)
 	return true
 }
 
+// expire removes held messages older than the TTL of the port and
+// returns them. Must be called with the port locked.
+func (f *PortFile) expire() (expired []heldMsg) {
+	if f.cfg.TTL == 0 {
+		return nil
+	}
+	now := time.Now()
+	for len(f.mailbox) > 0 && now.Sub(f.mailbox[0].stamp) >= f.cfg.TTL {
+		expired = append(expired, f.mailbox[0])
+		f.mailbox = f.mailbox[1:]
+	}
+	return
+}
+
+// sweep expired messages from the mailbox (called by the expiry timer)
+func (f *PortFile) sweep() {
+	f.Lock()
+	expired := f.expire()
+	f.expiry = nil
+	if len(f.mailbox) > 0 {
+		f.expiry = time.AfterFunc(time.Until(f.mailbox[0].stamp.Add(f.cfg.TTL)), f.sweep)
+	}
+	f.Unlock()
+
+	f.undelivered(heldMsgs(expired)...)
+	f.plmb.pruneDynamic(f)
+}
+
+// Held returns the number of messages in the mailbox
+func (f *PortFile) Held() int {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.mailbox)
+}
+
 // Open port file for reading
 func (f *PortFile) Open(fid uint64, omode proto.Mode) (err error) {
-	if f.watched {
-		return errors.New("file is in use")
+	slog.Debug("open", "file", f.Stat().Name, "fid", fid, "mode", omode)
+	if omode&3 != proto.Oread {
+		return ErrPerm
 	}
-	f.watched = true
 	f.Lock()
-	defer f.Unlock()
-	logger.Printf(logger.DBG, "Open{fid:%d,omode=%v}", fid, omode)
-
-	if omode == proto.Owrite {
-		return errors.New("file is read only")
+	if f.orphan {
+		f.Unlock()
+		return ErrNoPort
+	}
+	if f.cfg.Mode == PortSingle && len(f.readers) > 0 {
+		f.Unlock()
+		return ErrInUse
+	}
+	// the first reader gets the held messages (in order)
+	expired := f.expire()
+	r := &portReader{
+		lock:  newReadLock(),
+		queue: newMsgQueue(max(f.cfg.Queue, len(f.mailbox))),
 	}
-	f.skipped = 0
-	if !f.pending {
-		f.buf = []byte{}
+	for _, h := range f.mailbox {
+		r.queue.Push(h.msg, f.cfg, nil)
 	}
-	f.pending = false
+	f.mailbox = nil
+	if f.expiry != nil {
+		f.expiry.Stop()
+		f.expiry = nil
+	}
+	f.readers[fid] = r
+	f.order = append(f.order, fid)
+	f.Unlock()
+
+	f.undelivered(heldMsgs(expired)...)
 	return
 }
 
-// Read data at given position from port file
-func (f *PortFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+// reader returns the state of a reading fid
+func (f *PortFile) reader(fid uint64) (*portReader, error) {
 	f.RLock()
 	defer f.RUnlock()
-
-	if ofs < f.skipped {
-		return []byte{}, errors.New("illegal offset")
+	r, ok := f.readers[fid]
+	if !ok {
+		return nil, ErrBadFid
 	}
-	ofs -= f.skipped
+	return r, nil
+}
 
-	flen := uint64(len(f.buf))
-	if ofs >= flen {
-		f.skipped += flen
-		ofs -= flen
-		f.buf = <-f.post
-		flen = uint64(len(f.buf))
+// Read the next message from port file (see ReadContext)
+func (f *PortFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	return f.ReadContext(context.Background(), fid, ofs, count)
+}
+
+// ReadContext reads the next message from port file: offsets are ignored
+// and a read never returns more than one message. If a message does not
+// fit into a read, the remainder is returned by the following reads. A
+// read waiting for a message returns ErrIntr if the context is cancelled.
+func (f *PortFile) ReadContext(ctx context.Context, fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	r, err := f.reader(fid)
+	if err != nil {
+		return nil, err
 	}
-	last := min(ofs+count, flen)
-	data := f.buf[ofs:last]
-	logger.Printf(logger.DBG, "Read{fid:%d,ofs:%d,cnt:%d} -> [%d]", fid, ofs, count, len(data))
+	if err = r.lock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer r.lock.Unlock()
+	flen := uint64(len(r.buf))
+	if r.pos >= flen {
+		buf, err := f.wait(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if r.buf = buf; r.buf == nil {
+			return []byte{}, nil
+		}
+		r.pos = 0
+		flen = uint64(len(r.buf))
+	}
+	last := min(r.pos+count, flen)
+	data := r.buf[r.pos:last]
+	r.pos = last
+	slog.Debug("read", "file", f.Stat().Name, "fid", fid, "count", count, "result", len(data))
 	return data, nil
 }
 
 // Close port file
 func (f *PortFile) Close(fid uint64) (err error) {
-	logger.Printf(logger.DBG, "Close{fid:%d}", fid)
-	f.watched = false
+	slog.Debug("close", "file", f.Stat().Name, "fid", fid)
+	f.Lock()
+	r, ok := f.readers[fid]
+	if ok {
+		r.queue.Close()
+		delete(f.readers, fid)
+		f.order = slices.DeleteFunc(f.order, func(id uint64) bool { return id == fid })
+	}
+	f.Unlock()
+
+	// messages not read by the reader are undelivered
+	if ok {
+		f.undelivered(r.queue.Drain()...)
+	}
+	// an ad-hoc port is removed with its creator, an idle dynamic port
+	// with its last reader.
+	if f.creator != 0 && fid == f.creator {
+		f.plmb.removePort(f)
+	} else if ok {
+		f.plmb.pruneDynamic(f)
+	}
 	return
 }
+
+// Flush discards all messages held or queued on the port. Returns the
+// number of discarded messages.
+func (f *PortFile) Flush() int {
+	f.Lock()
+	defer f.Unlock()
+	n := len(f.mailbox)
+	f.mailbox = nil
+	if f.expiry != nil {
+		f.expiry.Stop()
+		f.expiry = nil
+	}
+	for _, r := range f.readers {
+		n += len(r.queue.Drain())
+	}
+	return n
+}
+
+// Orphan the port after it was removed from the namespace: the port
+// can't be opened anymore and readers get EOF after reading the queued
+// messages. Held messages are undelivered.
+func (f *PortFile) Orphan() {
+	f.Lock()
+	f.orphan = true
+	for _, r := range f.readers {
+		r.queue.Close()
+	}
+	held := f.mailbox
+	f.mailbox = nil
+	if f.expiry != nil {
+		f.expiry.Stop()
+		f.expiry = nil
+	}
+	f.Unlock()
+
+	f.undelivered(heldMsgs(held)...)
+}
+
+// retire orphans an idle port: the port has no readers and holds no
+// messages. Returns false if the port is in use.
+func (f *PortFile) retire() bool {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.readers) > 0 || len(f.mailbox) > 0 || f.orphan {
+		return false
+	}
+	f.orphan = true
+	if f.expiry != nil {
+		f.expiry.Stop()
+		f.expiry = nil
+	}
+	return true
+}
+
+// heldMsgs returns the messages of mailbox entries
+func heldMsgs(list []heldMsg) []*lib.Message {
+	msgs := make([]*lib.Message, len(list))
+	for i, h := range list {
+		msgs[i] = h.msg
+	}
+	return msgs
+}
@@ -0,0 +1,138 @@
+//go:build linux
+
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PeerUser returns the name of the local user on the other end of a
+// connection: the peer credentials of Unix sockets or the owner of the
+// client socket of a loopback TCP connection. Returns false if the user
+// can't be determined (e.g. for remote clients).
+func PeerUser(c net.Conn) (string, bool) {
+	if w, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = w.NetConn()
+	}
+	var (
+		uid int
+		ok  bool
+	)
+	switch nc := c.(type) {
+	case *net.UnixConn:
+		uid, ok = unixPeer(nc)
+	case *net.TCPConn:
+		uid, ok = tcpPeer(nc)
+	}
+	if !ok {
+		return "", false
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return "", false
+	}
+	return u.Username, true
+}
+
+// unixPeer returns the user id of the peer of a Unix socket
+func unixPeer(c *net.UnixConn) (uid int, ok bool) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	raw.Control(func(fd uintptr) {
+		cred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+		if err == nil {
+			uid, ok = int(cred.Uid), true
+		}
+	})
+	return
+}
+
+// tcpPeer returns the user id of the owner of the client socket of a
+// loopback connection (as listed in /proc/net/tcp{,6}).
+func tcpPeer(c *net.TCPConn) (int, bool) {
+	local, lok := c.LocalAddr().(*net.TCPAddr)
+	remote, rok := c.RemoteAddr().(*net.TCPAddr)
+	if !lok || !rok || !remote.IP.IsLoopback() {
+		return 0, false
+	}
+	// the client socket is bound to our remote address
+	for _, fname := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		v6 := strings.HasSuffix(fname, "6")
+		if uid, ok := socketOwner(fname, procAddr(remote, v6), procAddr(local, v6)); ok {
+			return uid, true
+		}
+	}
+	return 0, false
+}
+
+// procAddr formats an address as in /proc/net/tcp{,6}: the IP address as
+// 32-bit words in host byte order and the port (all hex).
+func procAddr(addr *net.TCPAddr, v6 bool) string {
+	ip := addr.IP.To4()
+	if v6 {
+		ip = addr.IP.To16()
+	}
+	if ip == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for i := 0; i < len(ip); i += 4 {
+		fmt.Fprintf(&sb, "%08X", binary.NativeEndian.Uint32(ip[i:]))
+	}
+	fmt.Fprintf(&sb, ":%04X", addr.Port)
+	return sb.String()
+}
+
+// socketOwner returns the user id of the socket with given local and
+// remote address in a /proc/net/tcp{,6} table
+func socketOwner(fname, local, remote string) (int, bool) {
+	if len(local) == 0 || len(remote) == 0 {
+		return 0, false
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	rdr := bufio.NewScanner(f)
+	for rdr.Scan() {
+		// sl local_address rem_address st tx:rx tr:when retrnsmt uid ...
+		fields := strings.Fields(rdr.Text())
+		if len(fields) < 8 || fields[1] != local || fields[2] != remote {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		return uid, err == nil
+	}
+	return 0, false
+}
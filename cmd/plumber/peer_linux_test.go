@@ -0,0 +1,64 @@
+//go:build linux
+
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"net"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerUser(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, addr := range []struct{ network, addr string }{
+		{"unix", filepath.Join(t.TempDir(), "plumb")},
+		{"tcp", "127.0.0.1:0"},
+		{"tcp", "[::1]:0"},
+	} {
+		l, err := net.Listen(addr.network, addr.addr)
+		if err != nil {
+			t.Log(err)
+			continue
+		}
+		c, err := net.Dial(addr.network, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc := newLifecycle()
+		name, ok := PeerUser(&trackedConn{Conn: sc, lc: lc})
+		if !ok || name != me.Username {
+			t.Errorf("%s: got user '%s' (%v), expected '%s'", addr.network, name, ok, me.Username)
+		}
+		c.Close()
+		sc.Close()
+		l.Close()
+	}
+}
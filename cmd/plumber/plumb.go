@@ -21,68 +21,442 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"log/slog"
 	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/bfix/gospel/logger"
 	"github.com/bfix/plumber/lib"
 	"github.com/knusbaum/go9p"
 	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
 )
 
 // Plumber with namespace handling
 type Plumber struct {
-	lib.Plumber // base plumber logic
+	*lib.Plumber // base plumber logic
 
-	srv   go9p.Srv             // 9P server
-	fs    *fs.FS               // synth. filesystem
-	root  *fs.StaticDir        // root folder
-	ports map[string]*PortFile // list of plumbing ports
-	Dry   bool                 // dry run (on exec)
+	srv       go9p.Srv             // 9P server
+	server    *Server              // plumber 9P server
+	Access    *Access              // access rules for namespace
+	fs        *fs.FS               // synth. filesystem
+	root      *fs.StaticDir        // root folder
+	rulesets  *fs.StaticDir        // folder of ruleset files
+	ports     map[string]*PortFile // list of plumbing ports
+	PortCfg   PortConfigs          // port configurations
+	pLock     sync.RWMutex         // guard port list and namespace
+	Dry       atomic.Bool          // dry run (on exec)
+	Compat    bool                 // plan9port compatibility mode
+	Addr      string               // TCP listen address (unauthenticated)
+	Remote    *TLSService          // TLS service for remote access
+	Watch     time.Duration        // poll interval for rule file changes
+	Grace     time.Duration        // grace period on shutdown
+	Terminate bool                 // terminate started programs on shutdown
+	DynPort   *regexp.Regexp       // names allowed for dynamic ports (or nil)
+	History   *History             // history of received messages
+	Stats     *Stats               // statistics of the service
+	Metrics   string               // HTTP listen address for metrics
+	Workers   int                  // number of evaluation workers (0: none)
+	Queue     int                  // max. number of queued messages
+	pool      *Pool                // evaluation workers
+	life      *lifecycle           // service lifecycle
+	snoop     *SnoopFile           // snoop file
 }
 
 // NewPlumber
 func NewPlumber() *Plumber {
-	return &Plumber{
-		ports: make(map[string]*PortFile),
+	p := &Plumber{
+		ports:   make(map[string]*PortFile),
+		Access:  NewAccess(),
+		PortCfg: NewPortConfigs(false),
+		Grace:   5 * time.Second,
+		History: NewHistory(DefaultHistory),
+		Stats:   NewStats(),
+		Workers: runtime.NumCPU(),
+		Queue:   DefaultQueue,
+		life:    newLifecycle(),
 	}
+	p.Plumber = lib.NewPlumber(p.NewWorker)
+	p.SetHooks(p.checkRules, p.rulesChanged)
+	p.SetObserver(p.Stats.Observe)
+	p.SetLogger(slog.Default())
+	return p
+}
+
+// names of files in the namespace that can't be used as port names
+var reservedNames = map[string]bool{
+	"ctl":      true,
+	"env":      true,
+	"history":  true,
+	"rules":    true,
+	"rulesets": true,
+	"send":     true,
+	"snoop":    true,
+	"stats":    true,
+	"test":     true,
+}
+
+// checkRules validates new rules: all referenced port names must be
+// usable as file names in the namespace.
+func (p *Plumber) checkRules(rl *lib.RuleList) error {
+	for _, name := range rl.Ports() {
+		if err := checkPortName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPortName returns an error if a name can't be used for a port
+func checkPortName(name string) error {
+	switch {
+	case len(name) == 0, name == ".", name == "..", strings.Contains(name, "/"):
+		return fmt.Errorf("invalid port name '%s'", name)
+	case reservedNames[name]:
+		return fmt.Errorf("port name '%s' is reserved", name)
+	}
+	return nil
 }
 
 // NamespaceService returns a service instance
 func (p *Plumber) NamespaceService() {
 	p.ports = make(map[string]*PortFile)
 
-	p.fs, p.root = fs.NewFS("plumb", "plumb", 0775)
-	p.root.AddChild(NewRulesFile(p.fs.NewStat("rules", "plumb", "plumb", 0666), p, p.SyncPorts))
-	p.root.AddChild(NewSendFile(p.fs.NewStat("send", "plumb", "plumb", 0222), p))
-	p.srv = p.fs.Server()
+	uid, gid, mode := p.Access.Root()
+	p.fs, p.root = fs.NewFS(uid, gid, mode)
+	p.root.AddChild(NewRulesFile(p.Access.NewStat(p.fs, "rules", rulesMode, false), p))
+	p.root.AddChild(NewSendFile(p.Access.NewStat(p.fs, "send", 0222, false), p))
+	p.root.AddChild(NewCtlFile(p.Access.NewStat(p.fs, "ctl", 0600, false), p))
+	p.root.AddChild(NewEnvFile(p.Access.NewStat(p.fs, "env", 0644, false), p))
+	p.snoop = NewSnoopFile(p.Access.NewStat(p.fs, "snoop", 0400, false), p)
+	p.root.AddChild(p.snoop)
+	p.root.AddChild(NewHistoryFile(p.Access.NewStat(p.fs, "history", 0400, false), p))
+	p.root.AddChild(NewStatsFile(p.Access.NewStat(p.fs, "stats", 0444, false), p))
+	p.root.AddChild(NewTestFile(p.Access.NewStat(p.fs, "test", 0666, false), p))
+	p.rulesets = fs.NewStaticDir(p.rulesetsStat())
+	p.root.AddChild(p.rulesets)
+	p.server = NewServer(p.root, p.Access)
+	p.server.CreateFile = p.createFile
+	p.server.RemoveFile = p.removeFile
+	p.srv = p.server
+	if p.Workers > 0 {
+		p.pool = NewPool(p.Workers, p.Queue, func(msg *lib.Message) (bool, error) {
+			defer p.life.leave()
+			return p.dispatch(msg)
+		})
+	}
+	p.rulesChanged()
+}
+
+// rulesChanged updates the namespace after rule changes
+func (p *Plumber) rulesChanged() {
 	p.SyncPorts()
+	p.SyncRulesets()
 }
 
-// SyncPorts after rule changes. New ports are created, but unused ports
-// are not removed from the filesystem.
+// createFile creates a new file on behalf of a client: an ad-hoc port
+// (in the root directory) or a ruleset (in the 'rulesets' directory).
+func (p *Plumber) createFile(dir fs.Dir, fid uint64, name, user string, perm uint32, mode proto.Mode) (fs.File, error) {
+	if perm&proto.DMDIR != 0 {
+		return nil, ErrPerm
+	}
+	switch dir {
+	case fs.Dir(p.root):
+		return p.createPort(fid, name, user, perm, mode)
+	case fs.Dir(p.rulesets):
+		return p.createRuleset(fid, name, user, mode)
+	}
+	return nil, ErrPerm
+}
+
+// removeFile removes a file on behalf of a client (rulesets only)
+func (p *Plumber) removeFile(node fs.FSNode, user string) error {
+	if f, ok := node.(*RulesetFile); ok && !f.insert {
+		return p.removeRuleset(f, user)
+	}
+	return ErrPerm
+}
+
+// SyncPorts after rule changes (called on every rule swap). New ports
+// are created; ports no longer referenced are removed from the namespace
+// and orphaned: their readers get EOF after the queued messages.
 func (p *Plumber) SyncPorts() {
+	var stale []*PortFile
+	defer func() {
+		for _, f := range stale {
+			f.Orphan()
+		}
+	}()
+	p.pLock.Lock()
+	defer p.pLock.Unlock()
+	if p.root == nil {
+		// namespace not set up yet
+		return
+	}
+	wanted := map[string]bool{UndeliveredPort: true}
 	for _, name := range p.Ports() {
+		wanted[name] = true
+	}
+	// dynamic ports are kept as long as rules reference dynamic ports;
+	// ad-hoc ports are kept as long as their creator keeps them open and
+	// the rules don't reference their names (the ad-hoc port is replaced
+	// by a port of the rules).
+	dynamic := len(p.DynamicPorts()) > 0
+	for name, f := range p.ports {
+		switch {
+		case f.creator != 0 && wanted[name]:
+			slog.Info("ad-hoc port replaced by rules", "port", name)
+			p.root.DeleteChild(name)
+			delete(p.ports, name)
+			stale = append(stale, f)
+		case (dynamic && f.dynamic && p.dynamicAllowed(name)) || f.creator != 0:
+			wanted[name] = true
+		}
+	}
+	for name := range wanted {
 		if _, ok := p.ports[name]; !ok {
-			f := NewPortFile(p.fs.NewStat(name, "plumb", "plumb", 0444))
+			f := NewPortFile(p.Access.NewStat(p.fs, name, 0444, true), p, p.PortCfg.Get(name))
 			p.ports[name] = f
 			p.root.AddChild(f)
 		}
 	}
+	for name, f := range p.ports {
+		if !wanted[name] {
+			slog.Info("port removed", "port", name)
+			p.root.DeleteChild(name)
+			delete(p.ports, name)
+			stale = append(stale, f)
+		}
+	}
+}
+
+// createPort creates an ad-hoc port in the root directory on behalf of a
+// client. The port is open for reading by its creator and removed when
+// the creator closes it.
+func (p *Plumber) createPort(fid uint64, name, user string, perm uint32, mode proto.Mode) (fs.File, error) {
+	if mode&3 != proto.Oread && mode&3 != proto.Ordwr {
+		return nil, ErrPerm
+	}
+	if err := checkPortName(name); err != nil {
+		return nil, err
+	}
+	p.pLock.Lock()
+	if _, ok := p.root.Children()[name]; ok {
+		p.pLock.Unlock()
+		return nil, ErrExist
+	}
+	f := NewPortFile(p.fs.NewStat(name, user, user, perm&0444), p, p.PortCfg.Get(name))
+	f.creator = fid
+	if err := f.Open(fid, proto.Oread); err != nil {
+		p.pLock.Unlock()
+		return nil, err
+	}
+	p.ports[name] = f
+	p.root.AddChild(f)
+	p.pLock.Unlock()
+
+	slog.Info("ad-hoc port created", "port", name, "user", user)
+	return f, nil
+}
+
+// removePort removes a port from the namespace and orphans it
+func (p *Plumber) removePort(f *PortFile) {
+	name := f.Stat().Name
+	p.pLock.Lock()
+	removed := p.ports[name] == f
+	if removed {
+		p.root.DeleteChild(name)
+		delete(p.ports, name)
+	}
+	p.pLock.Unlock()
+
+	if removed {
+		slog.Info("port removed", "port", name)
+	}
+	f.Orphan()
+}
+
+// Pack a message for delivery on a port. In compatibility mode the
+// plumb(6) wire format is used.
+func (p *Plumber) Pack(msg *lib.Message) []byte {
+	if p.Compat {
+		return msg.Pack()
+	}
+	return []byte(msg.String())
+}
+
+// Send a message received on the send file: the message is queued for
+// evaluation by the worker pool (or dispatched directly if there are no
+// workers) and the outcome of the evaluation is returned. Messages with
+// the same key (the sender) are evaluated in order.
+func (p *Plumber) Send(key string, msg *lib.Message) (done bool, err error) {
+	if p.pool == nil {
+		return p.Dispatch(msg)
+	}
+	if !p.life.enter() {
+		return false, ErrShutdown
+	}
+	// the evaluation leaves the lifecycle when it is done
+	res, err := p.pool.Submit(key, msg)
+	if err != nil {
+		p.life.leave()
+		return false, err
+	}
+	return p.pool.Wait(res)
+}
+
+// Dispatch a received message: the message is evaluated against the
+// rules; if no rule handles the message, it is posted on the port named
+// as destination (if any). Returns true if the message was delivered;
+// messages not delivered are posted on the 'undelivered' port.
+// The outcome is published on the snoop file (if it has readers).
+func (p *Plumber) Dispatch(msg *lib.Message) (done bool, err error) {
+	if !p.life.enter() {
+		return false, ErrShutdown
+	}
+	defer p.life.leave()
+	return p.dispatch(msg)
+}
+
+// dispatch a message (see Dispatch) while in the lifecycle
+func (p *Plumber) dispatch(msg *lib.Message) (done bool, err error) {
+	worker := p.NewWorker
+	var rec *snoopRecord
+	if p.snoop != nil && p.snoop.Active() {
+		rec = newRecord("snoop")
+		worker = rec.worker(p.NewWorker)
+	}
+	out, ref, err := p.Trace(msg, worker)
+	if out != nil {
+		slog.Info("message handled", "message", msg, "ruleset", ref.String())
+	}
+	if done = out != nil; err == nil && !done && len(msg.Dst) > 0 {
+		if p.port(msg.Dst) == nil {
+			err = ErrNoPort
+		} else {
+			done = p.FeedPort(msg.Dst, msg)
+			if rec != nil {
+				rec.action("to", msg.Dst, true, done)
+			}
+		}
+	}
+	if rec != nil {
+		if out == nil {
+			out = msg
+		}
+		p.snoop.Publish(rec.entry(p, out, ref, done, err))
+	}
+	p.History.Record(msg, ref, done, err)
+	if !done {
+		p.Undelivered(msg.Dst, msg)
+	}
+	return
+}
+
+// Reject data received on the send file that is not a valid message:
+// the data is published on the snoop file (if it has readers).
+func (p *Plumber) Reject(data []byte, err error) {
+	slog.Warn("received invalid message", "error", err)
+	p.Stats.Invalid()
+	if p.snoop != nil && p.snoop.Active() {
+		rec := newRecord("snoop")
+		p.snoop.Publish(rec.format(data, lib.Ref{Index: -1}, false, err))
+	}
+}
+
+// port returns the named port (or nil if not defined)
+func (p *Plumber) port(name string) *PortFile {
+	p.pLock.RLock()
+	defer p.pLock.RUnlock()
+	return p.ports[name]
 }
 
-// FeedPort post a message on the specified port.
+// FeedPort post a message on the specified port. Ports with names only
+// known at evaluation time are created on demand.
 func (p *Plumber) FeedPort(name string, msg *lib.Message) bool {
-	f, ok := p.ports[name]
+	f := p.port(name)
+	if f == nil {
+		if f = p.dynamicPort(name); f == nil {
+			return false
+		}
+	}
+	ok := f.Post(msg)
 	if !ok {
+		p.pruneDynamic(f)
+	}
+	return ok
+}
+
+// dynamicAllowed returns true if a port can be created on demand
+func (p *Plumber) dynamicAllowed(name string) bool {
+	if checkPortName(name) != nil {
 		return false
 	}
-	return f.Post(msg)
+	return p.DynPort == nil || p.DynPort.MatchString(name)
 }
 
-// KeepMsg for un-opened port file
-func (p *Plumber) KeepMsg(name string, msg *lib.Message) bool {
+// dynamicPort creates a port on demand; returns nil if the port name is
+// not allowed.
+func (p *Plumber) dynamicPort(name string) *PortFile {
+	if !p.dynamicAllowed(name) {
+		slog.Warn("dynamic port not allowed", "port", name)
+		return nil
+	}
+	p.pLock.Lock()
+	defer p.pLock.Unlock()
+	if p.root == nil {
+		return nil
+	}
 	f, ok := p.ports[name]
 	if !ok {
+		slog.Info("dynamic port created", "port", name)
+		f = NewPortFile(p.Access.NewStat(p.fs, name, 0444, true), p, p.PortCfg.Get(name))
+		f.dynamic = true
+		p.ports[name] = f
+		p.root.AddChild(f)
+	}
+	return f
+}
+
+// pruneDynamic removes a dynamic port from the namespace once it has no
+// readers and holds no messages.
+func (p *Plumber) pruneDynamic(f *PortFile) {
+	if !f.dynamic {
+		return
+	}
+	name := f.Stat().Name
+	p.pLock.Lock()
+	defer p.pLock.Unlock()
+	if p.ports[name] != f || !f.retire() {
+		return
+	}
+	p.root.DeleteChild(name)
+	delete(p.ports, name)
+	slog.Info("dynamic port removed", "port", name)
+}
+
+// Undelivered posts a message nobody collected on the 'undelivered' port
+func (p *Plumber) Undelivered(port string, msg *lib.Message) {
+	if len(port) > 0 {
+		slog.Warn("message not delivered", "message", msg, "port", port)
+	} else {
+		slog.Warn("message not delivered", "message", msg)
+	}
+	if f := p.port(UndeliveredPort); f != nil {
+		f.Post(msg)
+	}
+}
+
+// KeepMsg for un-opened port file
+func (p *Plumber) KeepMsg(name string, msg *lib.Message) bool {
+	f := p.port(name)
+	if f == nil {
 		return false
 	}
 	return f.Keep(msg)
@@ -100,7 +474,7 @@ func (p *Plumber) NewWorker() lib.Action {
 	return (&PlumbAction{
 		plmb: p,
 		port: "",
-		dry:  p.Dry,
+		dry:  p.Dry.Load(),
 	}).process
 }
 
@@ -108,7 +482,7 @@ func (p *Plumber) NewWorker() lib.Action {
 // 'ok' is true if the rule executes without failure/mismatch
 // 'done' is true if this action terminates the ruleset
 func (a *PlumbAction) process(msg *lib.Message, verb, data string) (ok, done bool) {
-	logger.Printf(logger.INFO, ">> plumb %s %s", verb, data)
+	slog.Info("plumb", "message", msg, "verb", verb, "data", data)
 	switch verb {
 	case "to":
 		ok = true
@@ -124,27 +498,33 @@ func (a *PlumbAction) process(msg *lib.Message, verb, data string) (ok, done boo
 		ok = true
 		done = true
 	}
-	logger.Printf(logger.INFO, "<< ok=%v, done=%v", ok, done)
+	slog.Info("plumb done", "verb", verb, "ok", ok, "done", done)
 	return
 }
 
 // Exec plumbing request
 func (a *PlumbAction) Exec(data string) {
-	if !a.dry {
-		go func() {
-			parts := lib.ParseParts(data)
-			cmd := exec.Command(parts[0], parts[1:]...)
-			logger.Println(logger.DBG, cmd.String())
-			stdout, err := cmd.Output()
-			if err != nil {
-				logger.Println(logger.ERROR, err.Error())
-				return
-			}
-			// Print the output
-			logger.Println(logger.DBG, string(stdout))
-			logger.Flush()
-		}()
-	} else {
-		logger.Printf(logger.INFO, ">> EXEC '%s'", data)
+	if a.dry {
+		slog.Info("dry run: program not started", "cmd", data)
+		return
+	}
+	parts := lib.ParseParts(data)
+	cmd := exec.Command(parts[0], parts[1:]...)
+	stdout := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	err := a.plmb.life.Start(cmd, func(err error) {
+		a.plmb.Stats.Exited(err)
+		if err != nil {
+			slog.Error("program failed", "cmd", cmd.String(), "pid", cmd.Process.Pid, "error", err)
+			return
+		}
+		// log the output
+		slog.Debug("program exited", "cmd", cmd.String(), "pid", cmd.Process.Pid, "output", stdout.String())
+	})
+	if err != nil {
+		slog.Error("can't start program", "cmd", cmd.String(), "error", err)
+		return
 	}
+	slog.Info("program started", "cmd", cmd.String(), "pid", cmd.Process.Pid)
+	a.plmb.Stats.Started()
 }
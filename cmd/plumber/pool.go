@@ -0,0 +1,159 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"sync"
+
+	"github.com/bfix/plumber/lib"
+)
+
+// DefaultQueue is the default number of messages queued for evaluation
+const DefaultQueue = 256
+
+// Pool is a bounded pool of evaluation workers fed by a queue. Messages
+// are queued per source (the sender, see Plumber.Send): the messages of
+// a source are evaluated one at a time in the order they were queued,
+// while messages of different sources are evaluated in parallel. If the queue is full, senders wait
+// for a free place.
+type Pool struct {
+	sync.Mutex
+
+	handle  func(*lib.Message) (bool, error) // evaluate a message
+	sources map[string]*source               // sources with queued messages
+	ready   chan *source                     // sources waiting for a worker
+	slots   chan struct{}                    // occupied places in the queue
+	quit    chan struct{}                    // closed when the pool stops
+	stop    sync.Once                        // stop the pool only once
+}
+
+// source is the queue of messages from one source
+type source struct {
+	key  string // source of the messages
+	jobs []*job // queued messages (oldest first)
+}
+
+// job is a queued message waiting for its evaluation
+type job struct {
+	msg  *lib.Message // message to be evaluated
+	done chan Result  // outcome of the evaluation
+}
+
+// Result is the outcome of the evaluation of a queued message
+type Result struct {
+	Delivered bool  // message was delivered
+	Err       error // evaluation failed
+}
+
+// NewPool starts a pool of workers that evaluate queued messages with
+// the handler; at most size messages are queued.
+func NewPool(workers, size int, handle func(*lib.Message) (bool, error)) *Pool {
+	size = max(size, 1)
+	p := &Pool{
+		handle:  handle,
+		sources: make(map[string]*source),
+		ready:   make(chan *source, size),
+		slots:   make(chan struct{}, size),
+		quit:    make(chan struct{}),
+	}
+	for range max(workers, 1) {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues a message of a source for evaluation; waits for a free
+// place if the queue is full. Returns the channel the outcome is
+// reported on (see Wait).
+func (p *Pool) Submit(key string, msg *lib.Message) (<-chan Result, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.quit:
+		return nil, ErrShutdown
+	}
+	j := &job{msg: msg, done: make(chan Result, 1)}
+	p.Lock()
+	defer p.Unlock()
+	s, ok := p.sources[key]
+	if !ok {
+		// a source enters the ready queue only once: the worker that
+		// evaluates its messages re-queues it.
+		s = &source{key: key}
+		p.sources[key] = s
+		p.ready <- s
+	}
+	s.jobs = append(s.jobs, j)
+	return j.done, nil
+}
+
+// Wait for the outcome of a queued message
+func (p *Pool) Wait(res <-chan Result) (bool, error) {
+	select {
+	case r := <-res:
+		return r.Delivered, r.Err
+	case <-p.quit:
+		return false, ErrShutdown
+	}
+}
+
+// Queued returns the number of queued messages (including messages in
+// evaluation).
+func (p *Pool) Queued() int {
+	return len(p.slots)
+}
+
+// Stop the workers; queued messages are no longer evaluated.
+func (p *Pool) Stop() {
+	p.stop.Do(func() {
+		close(p.quit)
+	})
+}
+
+// work evaluates the next message of a ready source until the pool is
+// stopped. A source with more messages is ready again afterwards, so
+// sources take turns.
+func (p *Pool) work() {
+	for {
+		var s *source
+		select {
+		case s = <-p.ready:
+		case <-p.quit:
+			return
+		}
+		p.Lock()
+		j := s.jobs[0]
+		s.jobs[0] = nil
+		s.jobs = s.jobs[1:]
+		p.Unlock()
+
+		ok, err := p.handle(j.msg)
+		j.done <- Result{ok, err}
+		<-p.slots
+
+		p.Lock()
+		if len(s.jobs) == 0 {
+			delete(p.sources, s.key)
+		} else {
+			p.ready <- s
+		}
+		p.Unlock()
+	}
+}
@@ -0,0 +1,287 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+func TestPoolOrder(t *testing.T) {
+	var (
+		mtx  sync.Mutex
+		seen = make(map[string][]string)
+	)
+	block := make(chan struct{})
+	pool := NewPool(4, 16, func(msg *lib.Message) (bool, error) {
+		if msg.Data == "slow-1" {
+			<-block
+		}
+		mtx.Lock()
+		seen[msg.Src] = append(seen[msg.Src], msg.Data)
+		mtx.Unlock()
+		return true, nil
+	})
+	defer pool.Stop()
+
+	submit := func(src, data string) <-chan Result {
+		res, err := pool.Submit(src, lib.NewMessage(src, "", "/", "text", data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	slow := []<-chan Result{submit("slow", "slow-1"), submit("slow", "slow-2")}
+	var fast []<-chan Result
+	for i := range 5 {
+		fast = append(fast, submit("fast", fmt.Sprintf("fast-%d", i)))
+	}
+	// other sources proceed while a source is blocked
+	for _, res := range fast {
+		if ok, err := pool.Wait(res); !ok || err != nil {
+			t.Fatalf("fast: %v, %v", ok, err)
+		}
+	}
+	mtx.Lock()
+	if len(seen["slow"]) != 0 {
+		t.Fatalf("blocked source evaluated: %v", seen["slow"])
+	}
+	mtx.Unlock()
+	close(block)
+	for _, res := range slow {
+		pool.Wait(res)
+	}
+	// messages of a source are evaluated in order
+	if !slices.Equal(seen["slow"], []string{"slow-1", "slow-2"}) {
+		t.Fatalf("slow: %v", seen["slow"])
+	}
+	if !slices.IsSorted(seen["fast"]) || len(seen["fast"]) != 5 {
+		t.Fatalf("fast: %v", seen["fast"])
+	}
+}
+
+func TestPoolQueue(t *testing.T) {
+	block := make(chan struct{})
+	pool := NewPool(1, 2, func(msg *lib.Message) (bool, error) {
+		<-block
+		return true, nil
+	})
+	msg := lib.NewMessage("plumb", "", "/", "text", "main.go")
+	for range 2 {
+		if _, err := pool.Submit("plumb", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// senders wait if the queue is full
+	queued := make(chan error, 1)
+	go func() {
+		_, err := pool.Submit("other", msg)
+		queued <- err
+	}()
+	select {
+	case <-queued:
+		t.Fatal("message queued beyond queue size")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := pool.Queued(); n != 2 {
+		t.Fatalf("%d messages queued", n)
+	}
+	block <- struct{}{}
+	if err := <-queued; err != nil {
+		t.Fatal(err)
+	}
+	// no messages are queued or evaluated after the pool stopped
+	pool.Stop()
+	res, err := pool.Submit("plumb", msg)
+	if err == nil {
+		_, err = pool.Wait(res)
+	}
+	if err != ErrShutdown {
+		t.Fatalf("after stop: %v", err)
+	}
+	close(block)
+}
+
+func TestSendQueued(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	reader := openPorts(t, p, "edit", 1)[0]
+
+	// messages of a sender are delivered in order
+	const n = 20
+	go func() {
+		for i := range n {
+			p.Send("conn", lib.NewMessage("plumb", "", "/", "text", fmt.Sprintf("f%02d.go", i)))
+		}
+	}()
+	for i := range n {
+		got := await(t, readAsync(reader, 8192))
+		if want := fmt.Sprintf("f%02d.go", i); !strings.HasSuffix(got, want) {
+			t.Fatalf("message %d: got %q", i, got)
+		}
+	}
+	// the outcome is reported to the sender
+	if ok, err := p.Send("conn", lib.NewMessage("plumb", "", "/", "text", "nothing")); ok || err != nil {
+		t.Fatalf("undelivered: %v, %v", ok, err)
+	}
+	if status := p.Shutdown(); status != ExitOK {
+		t.Fatalf("shutdown status %d", status)
+	}
+	if _, err := p.Send("conn", lib.NewMessage("plumb", "", "/", "text", "x.go")); err != ErrShutdown {
+		t.Fatalf("after shutdown: %v", err)
+	}
+}
+
+// Errors of the evaluation are returned on close of the send file, with
+// and without workers.
+func TestSendErrors(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		p := NewPlumber()
+		p.Dry.Store(true)
+		p.Workers = workers
+		p.Access.Owner = "glenda"
+		if err := p.ParsePlumbingFromRdr(strings.NewReader(testRules)); err != nil {
+			t.Fatal(err)
+		}
+		p.NamespaceService()
+		// (the 9P client of go9p drops errors of clunks)
+		f := p.root.Children()["send"].(*SendFile)
+		const fid = 1<<32 | 1
+		if err := f.Open(fid, proto.Owrite); err != nil {
+			t.Fatal(err)
+		}
+		msg := lib.NewMessage("plumb", "nowhere", "/", "text", "no rule for this")
+		if _, err := f.Write(fid, 0, []byte(msg.String())); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(fid); err != ErrNoPort {
+			t.Fatalf("workers=%d: close returned '%v'", workers, err)
+		}
+		p.Shutdown()
+	}
+}
+
+// Messages of different connections are evaluated in parallel, even if
+// they have the same source.
+func TestSendConnections(t *testing.T) {
+	p := newTestPlumber(t, testRules, false)
+	p.pool.Stop()
+	block := make(chan struct{})
+	p.pool = NewPool(2, DefaultQueue, func(msg *lib.Message) (bool, error) {
+		p.life.leave()
+		if msg.Data == "slow.go" {
+			<-block
+		}
+		return true, nil
+	})
+	send := func(cl *client.Client, data string) <-chan error {
+		res := make(chan error, 1)
+		go func() {
+			f, err := cl.Open("send", proto.Owrite)
+			if err == nil {
+				msg := lib.NewMessage("plumb", "", "/", "text", data)
+				if _, err = f.Write([]byte(msg.String())); err == nil {
+					err = f.Close()
+				}
+			}
+			res <- err
+		}()
+		return res
+	}
+	slow := send(dial(t, p, "glenda"), "slow.go")
+	select {
+	case err := <-send(dial(t, p, "glenda"), "fast.go"):
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection blocked by another connection")
+	}
+	close(block)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+//----------------------------------------------------------------------
+
+// benchRules start a program for Go files (dry run: the program is
+// only logged)
+const benchRules = `
+type	is	text
+data	matches	'[a-zA-Z0-9_\-./]+\.go'
+plumb	start	editor $0
+`
+
+// benchSend measures the throughput of messages sent from parallel
+// senders (each goroutine is a sender) with the given number of workers.
+func benchSend(b *testing.B, workers int) {
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	b.Cleanup(func() { slog.SetDefault(logger) })
+
+	p := NewPlumber()
+	p.Dry.Store(true)
+	p.Workers = workers
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(benchRules)); err != nil {
+		b.Fatal(err)
+	}
+	p.NamespaceService()
+	b.Cleanup(func() { p.Shutdown() })
+
+	var id sync.Mutex
+	next := 0
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id.Lock()
+		src := fmt.Sprintf("src%d", next)
+		next++
+		id.Unlock()
+		msg := lib.NewMessage(src, "", "/", "text", "main.go")
+		for pb.Next() {
+			if ok, err := p.Send(src, msg); !ok || err != nil {
+				b.Fatalf("send: %v, %v", ok, err)
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+func BenchmarkSendDirect(b *testing.B) {
+	benchSend(b, 0)
+}
+
+func BenchmarkSendPool1(b *testing.B) {
+	benchSend(b, 1)
+}
+
+func BenchmarkSendPool(b *testing.B) {
+	benchSend(b, runtime.NumCPU())
+}
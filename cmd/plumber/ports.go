@@ -0,0 +1,360 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+)
+
+// PortMode defines how messages are delivered to the readers of a port
+type PortMode int
+
+// Delivery modes of ports
+const (
+	PortSingle    PortMode = iota // only one reader
+	PortBroadcast                 // every reader gets every message
+	PortQueue                     // each message goes to one reader (round-robin)
+)
+
+// names of delivery modes
+var portModes = map[string]PortMode{
+	"single":    PortSingle,
+	"broadcast": PortBroadcast,
+	"queue":     PortQueue,
+}
+
+// String returns the name of a delivery mode
+func (m PortMode) String() string {
+	for name, mode := range portModes {
+		if mode == m {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// QueuePolicy defines what happens if a message is posted to a reader
+// with a full queue
+type QueuePolicy int
+
+// Policies for full queues
+const (
+	PolicyBlock      QueuePolicy = iota // wait for space (with timeout)
+	PolicyDropOldest                    // drop oldest queued message
+	PolicyDropNewest                    // drop posted message
+)
+
+// names of queue policies
+var queuePolicies = map[string]QueuePolicy{
+	"block":       PolicyBlock,
+	"drop-oldest": PolicyDropOldest,
+	"drop-newest": PolicyDropNewest,
+}
+
+// String returns the name of a queue policy
+func (p QueuePolicy) String() string {
+	for name, policy := range queuePolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// PortConfig is the configuration of a port
+type PortConfig struct {
+	Mode    PortMode      // delivery mode
+	Queue   int           // max. number of queued messages per reader
+	Policy  QueuePolicy   // policy for full queues
+	Timeout time.Duration // max. wait for space (block policy)
+	Mailbox int           // max. number of held messages (mailbox mode)
+	TTL     time.Duration // max. time a message is held (0: unlimited)
+}
+
+// PortConfigs for named ports ("*" for all other ports)
+type PortConfigs map[string]*PortConfig
+
+// DefaultPortConfig returns the configuration of ports without settings.
+// In plan9port compatibility mode every reader of a port gets a copy of
+// each message (like with the plumber of plan9port).
+func DefaultPortConfig(compat bool) PortConfig {
+	mode := PortSingle
+	if compat {
+		mode = PortBroadcast
+	}
+	return PortConfig{
+		Mode:    mode,
+		Queue:   16,
+		Policy:  PolicyBlock,
+		Timeout: time.Second,
+	}
+}
+
+// NewPortConfigs returns the default port configuration
+func NewPortConfigs(compat bool) PortConfigs {
+	cfg := DefaultPortConfig(compat)
+	return PortConfigs{"*": &cfg}
+}
+
+// Get the configuration for a port
+func (pc PortConfigs) Get(name string) *PortConfig {
+	if cfg, ok := pc[name]; ok {
+		return cfg
+	}
+	return pc["*"]
+}
+
+// ReadPortConfigs reads port configurations from a file
+func ReadPortConfigs(fname string, compat bool) (PortConfigs, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePortConfigs(f, compat)
+}
+
+// ParsePortConfigs reads port configurations from a reader. Each line
+// names a port ("*" for all ports not listed) followed by settings:
+//
+//	edit  mode=broadcast queue=32 policy=drop-oldest
+//	jobs  mode=queue policy=block timeout=5s
+//	image mailbox=8 ttl=10m
+//	*     mode=single
+//
+// Settings not given for a port have their default values (see
+// DefaultPortConfig). Empty lines
+// and comments (starting with '#') are ignored.
+func ParsePortConfigs(in io.Reader, compat bool) (PortConfigs, error) {
+	pc := NewPortConfigs(compat)
+	rdr := bufio.NewScanner(in)
+	for num := 1; rdr.Scan(); num++ {
+		line := strings.TrimSpace(rdr.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		parts := strings.Fields(line)
+		cfg := DefaultPortConfig(compat)
+		for _, setting := range parts[1:] {
+			if err := cfg.set(setting); err != nil {
+				return nil, fmt.Errorf("port config line %d: %s", num, err)
+			}
+		}
+		pc[parts[0]] = &cfg
+	}
+	return pc, rdr.Err()
+}
+
+// set a 'key=value' setting
+func (cfg *PortConfig) set(setting string) error {
+	key, val, _ := strings.Cut(setting, "=")
+	switch key {
+	case "mode":
+		mode, ok := portModes[val]
+		if !ok {
+			return fmt.Errorf("unknown mode '%s'", val)
+		}
+		cfg.Mode = mode
+	case "queue":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid queue size '%s'", val)
+		}
+		cfg.Queue = n
+	case "policy":
+		policy, ok := queuePolicies[val]
+		if !ok {
+			return fmt.Errorf("unknown policy '%s'", val)
+		}
+		cfg.Policy = policy
+	case "timeout":
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout '%s'", val)
+		}
+		cfg.Timeout = d
+	case "mailbox":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid mailbox size '%s'", val)
+		}
+		cfg.Mailbox = n
+	case "ttl":
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid ttl '%s'", val)
+		}
+		cfg.TTL = d
+	default:
+		return fmt.Errorf("unknown setting '%s'", setting)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------
+
+// msgQueue is a bounded queue of messages for a port reader
+type msgQueue struct {
+	msgs   []*lib.Message // queued messages
+	size   int            // max. number of messages
+	avail  chan struct{}  // signal: message available
+	space  chan struct{}  // signal: space available
+	closed chan struct{}  // closed with the queue
+	done   bool           // queue is closed
+
+	sync.Mutex
+}
+
+// newMsgQueue creates an empty queue of given size
+func newMsgQueue(size int) *msgQueue {
+	return &msgQueue{
+		size:   size,
+		avail:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// wake a waiting party (if not already signalled)
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of queued messages
+func (q *msgQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.msgs)
+}
+
+// Push a message to the queue. If the queue is full, the policy decides:
+// 'block' waits for space until the timeout expires, 'drop-oldest'
+// replaces the oldest message and 'drop-newest' discards the new message.
+// Returns true if the message was queued and the dropped message (if
+// any). Nothing is queued if the queue is closed or 'closing' is closed.
+func (q *msgQueue) Push(msg *lib.Message, cfg *PortConfig, closing <-chan struct{}) (bool, *lib.Message) {
+	var timeout <-chan time.Time
+	for {
+		q.Lock()
+		if q.done {
+			q.Unlock()
+			return false, nil
+		}
+		if len(q.msgs) < q.size {
+			q.msgs = append(q.msgs, msg)
+			if len(q.msgs) < q.size {
+				notify(q.space)
+			}
+			q.Unlock()
+			notify(q.avail)
+			return true, nil
+		}
+		switch cfg.Policy {
+		case PolicyDropOldest:
+			dropped := q.msgs[0]
+			q.msgs = append(q.msgs[1:], msg)
+			q.Unlock()
+			return true, dropped
+		case PolicyDropNewest:
+			q.Unlock()
+			return false, msg
+		}
+		q.Unlock()
+
+		// wait for space
+		if timeout == nil {
+			timeout = time.After(cfg.Timeout)
+		}
+		select {
+		case <-q.space:
+		case <-q.closed:
+		case <-closing:
+			return false, nil
+		case <-timeout:
+			return false, msg
+		}
+	}
+}
+
+// Pop the oldest message from the queue; waits for a message if the
+// queue is empty. Returns nil if the queue is closed (and empty) or if
+// 'closing' or 'cancel' is closed while waiting.
+func (q *msgQueue) Pop(closing, cancel <-chan struct{}) *lib.Message {
+	for {
+		q.Lock()
+		if len(q.msgs) > 0 {
+			msg := q.msgs[0]
+			q.msgs = q.msgs[1:]
+			if len(q.msgs) > 0 {
+				notify(q.avail)
+			}
+			q.Unlock()
+			notify(q.space)
+			return msg
+		}
+		done := q.done
+		q.Unlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-q.avail:
+		case <-q.closed:
+		case <-closing:
+			return nil
+		case <-cancel:
+			return nil
+		}
+	}
+}
+
+// Close the queue: no more messages are queued, queued messages can
+// still be read.
+func (q *msgQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+	if !q.done {
+		q.done = true
+		close(q.closed)
+	}
+}
+
+// Drain removes all queued messages
+func (q *msgQueue) Drain() []*lib.Message {
+	q.Lock()
+	defer q.Unlock()
+	msgs := q.msgs
+	q.msgs = nil
+	notify(q.space)
+	return msgs
+}
@@ -0,0 +1,557 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+const testPortConfigs = `
+# delivery modes
+edit	mode=broadcast
+web	mode=queue
+`
+
+// newPortPlumber returns a plumber (in compatibility mode) with port
+// configurations
+func newPortPlumber(t *testing.T, cfg string) *Plumber {
+	t.Helper()
+	pc, err := ParsePortConfigs(strings.NewReader(cfg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlumber()
+	p.Dry.Store(true)
+	p.Compat = true
+	p.PortCfg = pc
+	p.Access.Owner = "glenda"
+	if err = p.ParsePlumbingFromRdr(strings.NewReader(testRules)); err != nil {
+		t.Fatal(err)
+	}
+	p.NamespaceService()
+	return p
+}
+
+// open a port on new client connections
+func openPorts(t *testing.T, p *Plumber, port string, n int) []*client.File {
+	t.Helper()
+	list := make([]*client.File, n)
+	for i := range list {
+		f, err := dial(t, p, "glenda").Open(port, proto.Oread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		list[i] = f
+	}
+	return list
+}
+
+func TestPortConfigs(t *testing.T) {
+	pc, err := ParsePortConfigs(strings.NewReader(testPortConfigs+"*\tmode=queue\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range map[string]PortMode{
+		"edit":  PortBroadcast,
+		"web":   PortQueue,
+		"image": PortQueue,
+	} {
+		if got := pc.Get(name).Mode; got != mode {
+			t.Errorf("port '%s': mode %s, expected %s", name, got, mode)
+		}
+	}
+	pc, err = ParsePortConfigs(strings.NewReader("edit queue=4 policy=drop-newest timeout=2s\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := pc.Get("edit"); cfg.Queue != 4 || cfg.Policy != PolicyDropNewest || cfg.Timeout != 2*time.Second {
+		t.Errorf("unexpected config %+v", *cfg)
+	}
+	for _, cfg := range []string{
+		"edit mode=all\n", "edit size=3\n", "edit queue=0\n",
+		"edit policy=drop\n", "edit timeout=-1s\n", "edit mailbox=-1\n", "edit ttl=1\n",
+	} {
+		if _, err = ParsePortConfigs(strings.NewReader(cfg), false); err == nil {
+			t.Errorf("invalid config %q accepted", cfg)
+		}
+	}
+}
+
+func TestPortSingle(t *testing.T) {
+	p := newPortPlumber(t, "")
+	openPorts(t, p, "edit", 1)
+	if _, err := dial(t, p, "glenda").Open("edit", proto.Oread); err == nil {
+		t.Fatal("second reader accepted")
+	}
+}
+
+func TestPortBroadcast(t *testing.T) {
+	p := newPortPlumber(t, testPortConfigs)
+	readers := openPorts(t, p, "edit", 3)
+	sender := dial(t, p, "glenda")
+
+	for _, data := range []string{"a.go", "b.go"} {
+		res := make([]<-chan string, len(readers))
+		for i, r := range readers {
+			res[i] = readAsync(r, 8192)
+		}
+		msg := lib.NewMessage("plumb", "", "/", "text", data)
+		if err := plumb(sender, msg.Pack()); err != nil {
+			t.Fatal(err)
+		}
+		for i := range readers {
+			if got := await(t, res[i]); got != string(msg.Pack()) {
+				t.Fatalf("reader %d: got %q", i, got)
+			}
+		}
+	}
+}
+
+func TestPortQueue(t *testing.T) {
+	p := newPortPlumber(t, testPortConfigs)
+	readers := openPorts(t, p, "web", 2)
+	sender := dial(t, p, "glenda")
+
+	res := make([]<-chan string, len(readers))
+	for i, r := range readers {
+		res[i] = readAsync(r, 8192)
+	}
+	// messages go to the readers in turn
+	for i, data := range []string{"http://a", "http://b"} {
+		msg := lib.NewMessage("plumb", "", "/", "text", data)
+		if err := plumb(sender, msg.Pack()); err != nil {
+			t.Fatal(err)
+		}
+		if got := await(t, res[i]); got != string(msg.Pack()) {
+			t.Fatalf("reader %d: got %q", i, got)
+		}
+	}
+	// the next message goes to the first reader again
+	res[0] = readAsync(readers[0], 8192)
+	msg := lib.NewMessage("plumb", "", "/", "text", "http://c")
+	if err := plumb(sender, msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	if got := await(t, res[0]); got != string(msg.Pack()) {
+		t.Fatalf("reader 0: got %q", got)
+	}
+}
+
+func TestPortQueuePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   []string // messages left in the queue
+	}{
+		{"block", []string{"a.go", "b.go"}},
+		{"drop-oldest", []string{"c.go", "d.go"}},
+		{"drop-newest", []string{"a.go", "b.go"}},
+	} {
+		cfg := fmt.Sprintf("edit queue=2 policy=%s timeout=50ms\n", tc.policy)
+		p := newPortPlumber(t, cfg)
+		reader := openPorts(t, p, "edit", 1)[0]
+		sender := dial(t, p, "glenda")
+
+		// the reader does not read: sending must not block
+		sent := make(chan string, 1)
+		go func() {
+			for _, data := range []string{"a.go", "b.go", "c.go", "d.go"} {
+				msg := lib.NewMessage("plumb", "", "/", "text", data)
+				plumb(sender, msg.Pack())
+			}
+			sent <- "ok"
+		}()
+		await(t, sent)
+		if n := p.port("edit").Dropped(); n != 2 {
+			t.Errorf("%s: %d messages dropped", tc.policy, n)
+		}
+		if !strings.Contains(string(p.Settings()), "# port edit dropped 2\n") {
+			t.Errorf("%s: drops not reported", tc.policy)
+		}
+		for _, data := range tc.want {
+			msg := lib.NewMessage("plumb", "", "/", "text", data)
+			if got := await(t, readAsync(reader, 8192)); got != string(msg.Pack()) {
+				t.Fatalf("%s: got %q, expected %q", tc.policy, got, data)
+			}
+		}
+	}
+}
+
+func TestPortQueueBlock(t *testing.T) {
+	p := newPortPlumber(t, "edit queue=1 policy=block timeout=10s\n")
+	reader := openPorts(t, p, "edit", 1)[0]
+	sender := dial(t, p, "glenda")
+
+	msg := lib.NewMessage("plumb", "", "/", "text", "a.go")
+	if err := plumb(sender, msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	// the queue is full: the second message waits for the reader
+	sent := make(chan string, 1)
+	go func() {
+		msg := lib.NewMessage("plumb", "", "/", "text", "b.go")
+		if err := plumb(sender, msg.Pack()); err != nil {
+			sent <- err.Error()
+			return
+		}
+		sent <- "ok"
+	}()
+	select {
+	case <-sent:
+		t.Fatal("message not blocked on full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	for _, data := range []string{"a.go", "b.go"} {
+		msg := lib.NewMessage("plumb", "", "/", "text", data)
+		if got := await(t, readAsync(reader, 8192)); got != string(msg.Pack()) {
+			t.Fatalf("got %q", got)
+		}
+	}
+	if got := await(t, sent); got != "ok" {
+		t.Fatalf("blocked message: %s", got)
+	}
+	if n := p.port("edit").Dropped(); n != 0 {
+		t.Fatalf("%d messages dropped", n)
+	}
+}
+
+func TestPortMailbox(t *testing.T) {
+	p := newPortPlumber(t, "edit mailbox=2\n")
+	undelivered := openPorts(t, p, UndeliveredPort, 1)[0]
+	sender := dial(t, p, "glenda")
+
+	// messages are held while the port is not open
+	msgs := make([]*lib.Message, 3)
+	for i, data := range []string{"a.go", "b.go", "c.go"} {
+		msgs[i] = lib.NewMessage("plumb", "", "/", "text", data)
+		if err := plumb(sender, msgs[i].Pack()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the oldest message did not fit into the mailbox
+	if got := await(t, readAsync(undelivered, 8192)); got != string(msgs[0].Pack()) {
+		t.Fatalf("undelivered: got %q", got)
+	}
+	// the reader gets the held messages in order
+	reader := openPorts(t, p, "edit", 1)[0]
+	for _, msg := range msgs[1:] {
+		if got := await(t, readAsync(reader, 8192)); got != string(msg.Pack()) {
+			t.Fatalf("got %q", got)
+		}
+	}
+	if n := p.port("edit").Held(); n != 0 {
+		t.Fatalf("%d messages still held", n)
+	}
+}
+
+func TestPortMailboxTTL(t *testing.T) {
+	p := newPortPlumber(t, "edit mailbox=4 ttl=50ms\n")
+	undelivered := openPorts(t, p, UndeliveredPort, 1)[0]
+	sender := dial(t, p, "glenda")
+
+	res := readAsync(undelivered, 8192)
+	msg := lib.NewMessage("plumb", "", "/", "text", "a.go")
+	if err := plumb(sender, msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.port("edit").Held(); n != 1 {
+		t.Fatalf("%d messages held", n)
+	}
+	// expired message is undelivered
+	if got := await(t, res); got != string(msg.Pack()) {
+		t.Fatalf("undelivered: got %q", got)
+	}
+	if n := p.port("edit").Held(); n != 0 {
+		t.Fatalf("%d messages still held", n)
+	}
+}
+
+func TestPortUndelivered(t *testing.T) {
+	p := newPortPlumber(t, "")
+	undelivered := openPorts(t, p, UndeliveredPort, 1)[0]
+	sender := dial(t, p, "glenda")
+
+	// nobody reads the 'edit' port
+	res := readAsync(undelivered, 8192)
+	msg := lib.NewMessage("plumb", "", "/", "text", "a.go")
+	if err := plumb(sender, msg.Pack()); err == nil {
+		t.Fatal("message delivered")
+	}
+	if got := await(t, res); got != string(msg.Pack()) {
+		t.Fatalf("undelivered: got %q", got)
+	}
+}
+
+func TestPortStale(t *testing.T) {
+	p := newPortPlumber(t, "")
+	reader := openPorts(t, p, "web", 1)[0]
+	res := readAsync(reader, 8192)
+
+	// new rules without the 'web' port
+	rules := "type is text\nplumb to edit\n"
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	// the blocked reader gets EOF
+	if got := await(t, res); got != "" && got != "error: EOF" {
+		t.Fatalf("orphaned port: got %q", got)
+	}
+	// the port is gone from the namespace
+	if _, err := dial(t, p, "glenda").Open("web", proto.Oread); err == nil {
+		t.Fatal("removed port opened")
+	}
+	if p.port("web") != nil {
+		t.Fatal("removed port still active")
+	}
+	openPorts(t, p, "edit", 1)
+}
+
+func TestPortNames(t *testing.T) {
+	p := newPortPlumber(t, "")
+	for _, port := range []string{"rules", "send", "a/b", ".."} {
+		rules := "type is text\nplumb to " + port + "\n"
+		if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err == nil {
+			t.Errorf("port name '%s' accepted", port)
+		}
+	}
+	if string(p.File()) != testRules {
+		t.Fatal("active rules replaced by invalid rules")
+	}
+}
+
+func TestPortDynamic(t *testing.T) {
+	p := newPortPlumber(t, "* mailbox=1\n")
+	rules := "type is text\ndata matches 'port:([a-z]+)'\nplumb to $1\n"
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	p.DynPort = regexp.MustCompile("^(?:foo|bar)$")
+	sender := dial(t, p, "glenda")
+
+	// port is created on demand
+	msg := lib.NewMessage("plumb", "", "/", "text", "port:foo")
+	if err := plumb(sender, msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	reader := openPorts(t, p, "foo", 1)[0]
+	if got := await(t, readAsync(reader, 8192)); got != string(msg.Pack()) {
+		t.Fatalf("got %q", got)
+	}
+	// the idle port is removed with its last reader
+	reader.Close()
+	eventually(t, "removal of port 'foo'", func() bool { return p.port("foo") == nil })
+	// port name not allowed
+	plumb(sender, lib.NewMessage("plumb", "", "/", "text", "port:baz").Pack())
+	if p.port("baz") != nil {
+		t.Fatal("port 'baz' created")
+	}
+}
+
+func TestPortAdhoc(t *testing.T) {
+	p := newPortPlumber(t, "scratch mode=broadcast\n")
+	cl := dial(t, p, "glenda")
+	port, err := cl.Create("/scratch", 0444)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cl.Create("/scratch", 0444); err == nil {
+		t.Fatal("port created twice")
+	}
+	if _, err = cl.Create("/send", 0444); err == nil {
+		t.Fatal("reserved name accepted")
+	}
+	if _, err = dial(t, p, "alice").Create("/other", 0444); err == nil {
+		t.Fatal("port created by other user")
+	}
+	// messages are delivered to the port named as destination (the
+	// creator is a reader too, but the go9p client can't read from a
+	// created file)
+	reader := openPorts(t, p, "scratch", 1)[0]
+	sender := dial(t, p, "glenda")
+	msg := lib.NewMessage("plumb", "scratch", "/", "text", "hello")
+	res := readAsync(reader, 8192)
+	if err = plumb(sender, msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	if got := await(t, res); got != string(msg.Pack()) {
+		t.Fatalf("got %q", got)
+	}
+	// ports survive rule changes
+	if err = p.ParsePlumbingFromRdr(strings.NewReader(testRules)); err != nil {
+		t.Fatal(err)
+	}
+	if p.port("scratch") == nil {
+		t.Fatal("ad-hoc port removed on rule change")
+	}
+	// the port is removed with its creator (clunk is asynchronous)
+	port.Close()
+	for i := 0; p.port("scratch") != nil; i++ {
+		if i == 100 {
+			t.Fatal("ad-hoc port not removed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := await(t, readAsync(reader, 8192)); got != "" && got != "error: EOF" {
+		t.Fatalf("removed port: got %q", got)
+	}
+	if _, err = cl.Open("scratch", proto.Oread); err == nil {
+		t.Fatal("removed port opened")
+	}
+}
+
+func TestPortAdhocReplaced(t *testing.T) {
+	p := newPortPlumber(t, "scratch mode=broadcast\n")
+	port, err := dial(t, p, "glenda").Create("/scratch", 0444)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adhoc := p.port("scratch")
+	reader := openPorts(t, p, "scratch", 1)[0]
+	res := readAsync(reader, 8192)
+
+	// rules referencing the name of the ad-hoc port replace it
+	rules := testRules + "\ntype is text\ndata matches 'scratch:.*'\nplumb to scratch\n"
+	if err = p.ParsePlumbingFromRdr(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	if got := await(t, res); got != "" && got != "error: EOF" {
+		t.Fatalf("replaced port: got %q", got)
+	}
+	f := p.port("scratch")
+	if f == nil || f == adhoc || f.creator != 0 {
+		t.Fatal("ad-hoc port not replaced")
+	}
+	// the port of the rules outlives the creator of the ad-hoc port
+	port.Close()
+	time.Sleep(50 * time.Millisecond)
+	if p.port("scratch") != f {
+		t.Fatal("port removed with creator of the ad-hoc port")
+	}
+}
+
+func TestPortReads(t *testing.T) {
+	msgs := []*lib.Message{
+		lib.NewMessage("plumb", "", "/", "text", "https://9p.io/plan9/"),
+		lib.NewMessage("plumb", "", "/", "text", "http://p9f.org"),
+	}
+	for _, compat := range []bool{false, true} {
+		p := newTestPlumber(t, testRules, compat)
+		size := len(p.Pack(msgs[1]))
+		for _, bufSize := range []int{1, 16, size - 1, size, 8192} {
+			t.Run(fmt.Sprintf("compat=%v,buf=%d", compat, bufSize), func(t *testing.T) {
+				// the reader of the previous run is clunked asynchronously
+				awaitReaders(t, p, "web", 0)
+				port := openPorts(t, p, "web", 1)[0]
+				sender := dial(t, p, "glenda")
+				for _, msg := range msgs {
+					if err := plumb(sender, p.Pack(msg)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// a read returns at most one message; the remainder of a
+				// message is returned by the following reads.
+				for _, msg := range msgs {
+					exp := string(p.Pack(msg))
+					got, reads := "", 0
+					for len(got) < len(exp) {
+						s := await(t, readAsync(port, bufSize))
+						if len(s) == 0 || len(s) > bufSize {
+							t.Fatalf("read of %d bytes with buffer size %d", len(s), bufSize)
+						}
+						got += s
+						reads++
+					}
+					if got != exp {
+						t.Fatalf("got %q, expected %q", got, exp)
+					}
+					if n := (len(exp) + bufSize - 1) / bufSize; reads != n {
+						t.Fatalf("%d reads, expected %d", reads, n)
+					}
+				}
+			})
+		}
+	}
+}
+
+// readConcurrently reads from a fid in several goroutines (like
+// concurrent Treads) until the expected number of bytes is read. Reads
+// must neither duplicate nor lose bytes.
+func readConcurrently(t *testing.T, read func(ctx context.Context) ([]byte, error), total int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var (
+		mtx sync.Mutex
+		n   int
+		wg  sync.WaitGroup
+	)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				data, err := read(ctx)
+				if err != nil {
+					return
+				}
+				mtx.Lock()
+				if n += len(data); n >= total {
+					cancel()
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if n != total {
+		t.Fatalf("read %d bytes, expected %d", n, total)
+	}
+}
+
+func TestPortConcurrentReads(t *testing.T) {
+	p := newTestPlumber(t, testRules, false)
+	f := p.port("web")
+	if err := f.Open(1, proto.Oread); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close(1)
+	total := 0
+	for i := range f.cfg.Queue {
+		msg := lib.NewMessage("plumb", "", "/", "text", fmt.Sprintf("https://9p.io/%d", i))
+		if !f.Post(msg) {
+			t.Fatal("message not posted")
+		}
+		total += len(p.Pack(msg))
+	}
+	readConcurrently(t, func(ctx context.Context) ([]byte, error) {
+		return f.ReadContext(ctx, 1, 0, 7)
+	}, total)
+}
@@ -0,0 +1,239 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// RulesetFile ('/mnt/plumb/rulesets/<n>') is the text of the active
+// ruleset with index n. Writing to the file replaces the ruleset (after
+// validation) when the file is closed.
+type RulesetFile struct {
+	fs.BaseFile
+
+	plmb   *Plumber                // reference to plumber instance
+	idx    int                     // index of ruleset
+	insert bool                    // insert new ruleset at index
+	edits  map[uint64]*rulesetEdit // fid-mapped state
+	mtx    sync.Mutex              // guard fid-mapped state
+}
+
+// rulesetEdit is the state of a fid on a ruleset file
+type rulesetEdit struct {
+	rs      *lib.RuleSet // ruleset on open (nil for new ruleset)
+	content []byte       // ruleset text
+	mode    proto.Mode   // open mode
+}
+
+// NewRulesetFile creates a file for the ruleset with given index
+func NewRulesetFile(s *proto.Stat, plmb *Plumber, idx int) *RulesetFile {
+	return &RulesetFile{
+		BaseFile: *fs.NewBaseFile(s),
+		plmb:     plmb,
+		idx:      idx,
+		edits:    make(map[uint64]*rulesetEdit),
+	}
+}
+
+// ruleset returns the active ruleset of the file (or nil)
+func (f *RulesetFile) ruleset() *lib.RuleSet {
+	if f.insert {
+		return nil
+	}
+	list := f.plmb.Rulesets()
+	if f.idx >= len(list) {
+		return nil
+	}
+	return list[f.idx]
+}
+
+// rulesetText returns a ruleset as text
+func rulesetText(rs *lib.RuleSet) []byte {
+	if rs == nil {
+		return []byte{}
+	}
+	return []byte(rs.String() + "\n")
+}
+
+// Stat returns the current file stats
+func (f *RulesetFile) Stat() proto.Stat {
+	s := f.BaseFile.Stat()
+	s.Length = uint64(len(rulesetText(f.ruleset())))
+	return s
+}
+
+// Open ruleset file: the content is the ruleset at the time of opening
+// (empty if opened for truncation).
+func (f *RulesetFile) Open(fid uint64, omode proto.Mode) error {
+	rs := f.ruleset()
+	if rs == nil && !f.insert {
+		return ErrNotExist
+	}
+	e := &rulesetEdit{rs: rs, mode: omode}
+	if omode&proto.Otrunc == 0 {
+		e.content = rulesetText(rs)
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.edits[fid] = e
+	return nil
+}
+
+// Read ruleset text
+func (f *RulesetFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	e, ok := f.edits[fid]
+	if !ok {
+		return nil, ErrBadFid
+	}
+	flen := uint64(len(e.content))
+	if ofs >= flen {
+		return []byte{}, nil
+	}
+	last := min(ofs+count, flen)
+	return e.content[ofs:last], nil
+}
+
+// Write ruleset text at given position
+func (f *RulesetFile) Write(fid uint64, ofs uint64, buf []byte) (uint32, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	e, ok := f.edits[fid]
+	if !ok {
+		return 0, ErrBadFid
+	}
+	if ofs > uint64(len(e.content)) {
+		return 0, ErrOffset
+	}
+	e.content = append(e.content[:ofs], buf...)
+	return uint32(len(buf)), nil
+}
+
+// Close ruleset file: written text replaces the ruleset (or is inserted
+// as a new ruleset).
+func (f *RulesetFile) Close(fid uint64) error {
+	f.mtx.Lock()
+	e, ok := f.edits[fid]
+	delete(f.edits, fid)
+	f.mtx.Unlock()
+	if !ok || e.mode&3 == proto.Oread || (f.insert && len(e.content) == 0) {
+		return nil
+	}
+	rs, err := lib.ParseRuleSetFromRdr(bytes.NewReader(e.content))
+	if err != nil {
+		return err
+	}
+	if f.insert {
+		return f.plmb.InsertRuleset(f.idx, rs)
+	}
+	return f.plmb.ReplaceRuleset(e.rs, rs)
+}
+
+//----------------------------------------------------------------------
+
+// rulesMode is the default mode of the 'rules' file: rules start programs
+// as the owner of the plumber, so only the owner can change them.
+const rulesMode = 0644
+
+// rulesetsStat returns the stat of the 'rulesets' directory: owner,
+// group and permissions follow the 'rules' file (with search access
+// where the rules are readable).
+func (p *Plumber) rulesetsStat() *proto.Stat {
+	st := p.Access.NewStat(p.fs, "rules", rulesMode, false)
+	st.Name = "rulesets"
+	st.Mode |= (st.Mode & 0444) >> 2
+	return st
+}
+
+// rulesWritable returns true if the user is allowed to change the rules
+func (p *Plumber) rulesWritable(user string) bool {
+	rules, ok := p.root.Children()["rules"]
+	return ok && p.Access.Permit(rules, user, proto.Owrite)
+}
+
+// rulesetStat returns the stat of a ruleset file: access is the same as
+// for the 'rules' file.
+func (p *Plumber) rulesetStat(idx int) *proto.Stat {
+	st := p.Access.NewStat(p.fs, "rules", rulesMode, false)
+	st.Name = strconv.Itoa(idx)
+	return st
+}
+
+// SyncRulesets after rule changes: there is a file for every active
+// ruleset in the 'rulesets' directory.
+func (p *Plumber) SyncRulesets() {
+	p.pLock.Lock()
+	defer p.pLock.Unlock()
+	if p.rulesets == nil {
+		// namespace not set up yet
+		return
+	}
+	n := len(p.Rulesets())
+	files := p.rulesets.Children()
+	for idx := range n {
+		if _, ok := files[strconv.Itoa(idx)]; !ok {
+			p.rulesets.AddChild(NewRulesetFile(p.rulesetStat(idx), p, idx))
+		}
+	}
+	for name, node := range files {
+		if f, ok := node.(*RulesetFile); ok && f.idx >= n {
+			p.rulesets.DeleteChild(name)
+		}
+	}
+}
+
+// createRuleset creates a new ruleset file: the ruleset written to the
+// file is inserted at the index given as name when the file is closed.
+func (p *Plumber) createRuleset(fid uint64, name, user string, mode proto.Mode) (fs.File, error) {
+	if !p.rulesWritable(user) {
+		return nil, ErrPerm
+	}
+	idx, err := strconv.Atoi(name)
+	if err != nil || idx < 0 || idx > len(p.Rulesets()) || name != strconv.Itoa(idx) {
+		return nil, ErrPerm
+	}
+	f := NewRulesetFile(p.rulesetStat(idx), p, idx)
+	f.insert = true
+	if err = f.Open(fid, mode|proto.Otrunc); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// removeRuleset removes the ruleset of a file
+func (p *Plumber) removeRuleset(f *RulesetFile, user string) error {
+	if !p.rulesWritable(user) {
+		return ErrPerm
+	}
+	rs := f.ruleset()
+	if rs == nil {
+		return ErrNotExist
+	}
+	return p.ReplaceRuleset(rs, nil)
+}
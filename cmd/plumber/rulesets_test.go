@@ -0,0 +1,182 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knusbaum/go9p/proto"
+)
+
+// eventually waits until a condition is met (e.g. after an asynchronous
+// clunk by the client)
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for range 200 {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for " + what)
+}
+
+func TestRulesetFiles(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	cl := dial(t, p, "glenda")
+
+	// one file per ruleset
+	f, err := cl.Open("rulesets/0", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "type is text\ndata matches '[a-zA-Z0-9_\\-./]+\\.go'\nplumb to edit\n"
+	if string(data) != exp {
+		t.Fatalf("ruleset 0: got %q, expected %q", data, exp)
+	}
+	if _, err = cl.Open("rulesets/2", proto.Oread); err == nil {
+		t.Fatal("unknown ruleset opened")
+	}
+
+	// replace a ruleset
+	if f, err = cl.Open("rulesets/1", proto.Owrite|proto.Otrunc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("type is text\ndata matches 'ftp://.*'\nplumb to web\n")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	eventually(t, "replaced ruleset", func() bool {
+		return strings.Contains(p.Rulesets()[1].String(), "ftp://")
+	})
+
+	// insert a new ruleset (the go9p client ignores the iounit of
+	// Rcreate and can't write to created files)
+	rc := dialRaw(t, p, "rules")
+	text := "type is text\nplumb to image\n"
+	rc.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk}, Fid: 0, Newfid: 2, Nwname: 1, Wname: []string{"rulesets"}})
+	rc.rpc(&proto.TCreate{Header: proto.Header{Type: proto.Tcreate}, Fid: 2, Name: "2", Perm: 0666, Mode: uint8(proto.Owrite)})
+	rc.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite}, Fid: 2, Count: uint32(len(text)), Data: []byte(text)})
+	rc.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk}, Fid: 2})
+	eventually(t, "new ruleset", func() bool { return len(p.Rulesets()) == 3 })
+	if p.port("image") == nil {
+		t.Fatal("port of new ruleset missing")
+	}
+	if !strings.Contains(string(p.File()), "plumb to image") {
+		t.Fatal("rules text not updated")
+	}
+
+	// remove a ruleset
+	if err = cl.Remove("rulesets/0"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.Rulesets()); n != 2 || p.port("edit") != nil {
+		t.Fatalf("ruleset not removed (%d rulesets)", n)
+	}
+	if _, ok := p.rulesets.Children()["2"]; ok {
+		t.Fatal("file of removed ruleset still present")
+	}
+}
+
+func TestRulesetInvalid(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	rc := dialRaw(t, p, "rules")
+	for tag, text := range []string{
+		"type is text\nplumb to edit\n\ntype is text\nplumb to web\n",
+		"type is\n",
+		"editor = sam\n",
+	} {
+		rc.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk}, Fid: 0, Newfid: 2, Nwname: 2, Wname: []string{"rulesets", "0"}})
+		rc.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen}, Fid: 2, Mode: proto.Owrite | proto.Otrunc})
+		rc.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite}, Fid: 2, Count: uint32(len(text)), Data: []byte(text)})
+		rc.send(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: uint16(tag)}, Fid: 2})
+		if _, ok := rc.reply().(*proto.RError); !ok {
+			t.Errorf("invalid ruleset %q accepted", text)
+		}
+	}
+	if string(p.File()) != testRules {
+		t.Fatal("rules modified")
+	}
+}
+
+func TestRulesetAccess(t *testing.T) {
+	p := NewPlumber()
+	p.Dry.Store(true)
+	acl, err := ParseAccess(strings.NewReader("file rules plumb plumb 0644\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Access = acl
+	if err = p.ParsePlumbingFromRdr(strings.NewReader(testRules)); err != nil {
+		t.Fatal(err)
+	}
+	p.NamespaceService()
+
+	// only the owner of the rules can change rulesets
+	for user, exp := range map[string]bool{"glenda": false, "plumb": true} {
+		cl := dial(t, p, user)
+		if _, err = cl.Open("rulesets/0", proto.Oread); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cl.Create("rulesets/2", 0666); (err == nil) != exp {
+			t.Errorf("%s: create returned '%v'", user, err)
+		}
+		if err = cl.Remove("rulesets/1"); (err == nil) != exp {
+			t.Errorf("%s: remove returned '%v'", user, err)
+		}
+	}
+}
+
+func TestRulesetDefaultModes(t *testing.T) {
+	p := newTestPlumber(t, testRules, false)
+	for name, exp := range map[string]uint32{
+		"rules":      0644,
+		"rulesets":   proto.DMDIR | 0755,
+		"rulesets/0": 0644,
+		"rulesets/1": 0644,
+	} {
+		st, err := dial(t, p, "glenda").Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode != exp {
+			t.Errorf("%s: mode %o, expected %o", name, st.Mode, exp)
+		}
+	}
+	// other users can't change rules or rulesets
+	alice := dial(t, p, "alice")
+	for _, name := range []string{"rules", "rulesets/0"} {
+		if _, err := alice.Open(name, proto.Owrite); err == nil {
+			t.Errorf("%s opened for writing by other user", name)
+		}
+	}
+	if _, err := alice.Create("rulesets/2", 0644); err == nil {
+		t.Error("ruleset created by other user")
+	}
+}
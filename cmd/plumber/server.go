@@ -0,0 +1,633 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// ErrNoAuth is returned on authentication requests
+var ErrNoAuth = errors.New("plumber: authentication not required")
+
+// size of a Rread header: size[4] type[1] tag[2] count[4]
+const rreadHdrSize = 11
+
+//----------------------------------------------------------------------
+
+// fidInfo is the state of a fid on a connection
+type fidInfo struct {
+	node fs.FSNode   // filesystem node
+	user string      // 9P user name (from attach)
+	mode proto.Mode  // open mode (proto.None if not opened)
+	dir  []fs.FSNode // directory content (on open)
+}
+
+// Conn is a client connection to the 9P server
+type Conn struct {
+	srv  *Server             // server of the connection
+	id   uint32              // connection identifier
+	fids map[uint32]*fidInfo // fid-mapped state
+	tags sync.Map            // tag-mapped request contexts
+	size uint32              // negotiated message size
+
+	sync.Mutex
+}
+
+// TagContext returns the context of a pending request
+func (c *Conn) TagContext(tag uint16) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	v, _ := c.tags.LoadOrStore(tag, &tagContext{ctx, cancel})
+	return v.(*tagContext).ctx
+}
+
+// DropContext releases the context of a finished request
+func (c *Conn) DropContext(tag uint16) {
+	if v, ok := c.tags.LoadAndDelete(tag); ok {
+		v.(*tagContext).cancel()
+	}
+}
+
+// context returns the context of a pending request; a request that is
+// no longer pending (flushed or cancelled) has a cancelled context.
+func (c *Conn) context(tag uint16) context.Context {
+	if v, ok := c.tags.Load(tag); ok {
+		return v.(*tagContext).ctx
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// context of a pending request
+type tagContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// fid returns the state of a fid
+func (c *Conn) fid(fid uint32) (*fidInfo, bool) {
+	c.Lock()
+	defer c.Unlock()
+	info, ok := c.fids[fid]
+	return info, ok
+}
+
+// setFid sets the state of a fid
+func (c *Conn) setFid(fid uint32, info *fidInfo) {
+	c.Lock()
+	defer c.Unlock()
+	c.fids[fid] = info
+}
+
+// dropFid removes a fid from the connection
+func (c *Conn) dropFid(fid uint32) (*fidInfo, bool) {
+	c.Lock()
+	defer c.Unlock()
+	info, ok := c.fids[fid]
+	delete(c.fids, fid)
+	return info, ok
+}
+
+// connection-unique fid (as used by go9p/fs)
+func (c *Conn) connFid(fid uint32) uint64 {
+	return uint64(c.id)<<32 | uint64(fid)
+}
+
+// connID returns the connection of a connection-unique fid
+func connID(fid uint64) uint32 {
+	return uint32(fid >> 32)
+}
+
+// Close the connection: all fids are clunked (closing open files).
+func (c *Conn) Close() error {
+	c.Lock()
+	fids := c.fids
+	c.fids = make(map[uint32]*fidInfo)
+	c.Unlock()
+	for fid, info := range fids {
+		c.srv.close(c, fid, info)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------
+
+// ContextReader is implemented by files with blocking reads: the read
+// returns early if the context is cancelled (the request was flushed or
+// the client went away).
+type ContextReader interface {
+	ReadContext(ctx context.Context, fid uint64, ofs uint64, count uint64) ([]byte, error)
+}
+
+// Serve 9P requests read from r on a new connection of srv; replies are
+// written to w. Every request is handled in its own goroutine, so a
+// blocking read does not stall the connection. Unlike the server loop
+// of go9p, a flushed request is cancelled and answered (unless it was
+// interrupted) before the flush. If the client goes away, all pending requests are
+// cancelled and all fids of the connection are clunked.
+func Serve(r io.Reader, w io.Writer, srv go9p.Srv) error {
+	conn := srv.NewConn()
+	var (
+		pending sync.Map // tag-mapped pending requests (closed when done)
+		wg      sync.WaitGroup
+		wmtx    sync.Mutex
+	)
+	reply := func(fc proto.FCall) {
+		wmtx.Lock()
+		defer wmtx.Unlock()
+		if _, err := w.Write(fc.Compose()); err != nil {
+			slog.Debug("9P reply failed", "error", err)
+		}
+	}
+	for {
+		call, err := proto.ParseCall(r)
+		if err != nil {
+			// cancel pending requests and release fids
+			pending.Range(func(tag, _ any) bool {
+				conn.DropContext(tag.(uint16))
+				return true
+			})
+			wg.Wait()
+			if c, ok := conn.(io.Closer); ok {
+				c.Close()
+			}
+			return err
+		}
+		tag := call.GetTag()
+		ctx := conn.TagContext(tag)
+		done := make(chan struct{})
+		pending.Store(tag, done)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var (
+				resp proto.FCall
+				err  error
+			)
+			if t, ok := call.(*proto.TFlush); ok {
+				// cancel the flushed request and wait for it
+				if v, ok := pending.Load(t.Oldtag); ok && t.Oldtag != tag {
+					conn.DropContext(t.Oldtag)
+					<-v.(chan struct{})
+				}
+				resp = &proto.RFlush{Header: proto.Header{Type: proto.Rflush, Tag: tag}}
+			} else if resp, err = dispatch(srv, conn, call); err != nil {
+				resp = rerror(tag, err)
+			}
+			// a request interrupted by a flush is not answered; a request
+			// completed before (e.g. a read that already took a message)
+			// is answered before the flush, so no message gets lost. The
+			// tag can be reused once the reply is sent.
+			flushed := ctx.Err() != nil && interrupted(resp)
+			conn.DropContext(tag)
+			if !flushed {
+				reply(resp)
+			}
+			pending.CompareAndDelete(tag, done)
+			close(done)
+		}()
+	}
+}
+
+// interrupted returns true if a request failed because it was cancelled
+func interrupted(resp proto.FCall) bool {
+	e, ok := resp.(*proto.RError)
+	return ok && e.Ename == ErrIntr.Error()
+}
+
+// dispatch a 9P request to the service
+func dispatch(srv go9p.Srv, conn go9p.Conn, call proto.FCall) (proto.FCall, error) {
+	switch t := call.(type) {
+	case *proto.TRVersion:
+		return srv.Version(conn, t)
+	case *proto.TAuth:
+		return srv.Auth(conn, t)
+	case *proto.TAttach:
+		return srv.Attach(conn, t)
+	case *proto.TWalk:
+		return srv.Walk(conn, t)
+	case *proto.TOpen:
+		return srv.Open(conn, t)
+	case *proto.TCreate:
+		return srv.Create(conn, t)
+	case *proto.TRead:
+		return srv.Read(conn, t)
+	case *proto.TWrite:
+		return srv.Write(conn, t)
+	case *proto.TClunk:
+		return srv.Clunk(conn, t)
+	case *proto.TRemove:
+		return srv.Remove(conn, t)
+	case *proto.TStat:
+		return srv.Stat(conn, t)
+	case *proto.TWstat:
+		return srv.Wstat(conn, t)
+	}
+	return nil, fmt.Errorf("invalid 9P request %T", call)
+}
+
+//----------------------------------------------------------------------
+
+// Server for the plumber namespace. Unlike the generic 9P server of
+// go9p/fs it keeps track of the 9P user of open files, so files can act
+// on behalf of their clients, and it checks permissions against the
+// access rules of the plumber.
+type Server struct {
+	root   fs.Dir        // root of namespace
+	access *Access       // access rules
+	users  sync.Map      // user names of open files (connFid -> user)
+	lastID atomic.Uint32 // last connection identifier
+
+	// CreateFile creates a new file in a directory on behalf of a user
+	// and opens it for the (connection-unique) fid. Files can't be
+	// created if not set.
+	CreateFile func(dir fs.Dir, fid uint64, name, user string, perm uint32, mode proto.Mode) (fs.File, error)
+
+	// RemoveFile removes a node on behalf of a user (who is allowed to
+	// write the parent directory). Nodes can't be removed if not set.
+	RemoveFile func(node fs.FSNode, user string) error
+}
+
+// NewServer creates a 9P server for a namespace
+func NewServer(root fs.Dir, access *Access) *Server {
+	return &Server{
+		root:   root,
+		access: access,
+	}
+}
+
+// User returns the 9P user who opened the (connection-unique) fid
+func (s *Server) User(fid uint64) string {
+	if v, ok := s.users.Load(fid); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// error response
+func rerror(tag uint16, err error) proto.FCall {
+	return &proto.RError{
+		Header: proto.Header{Type: proto.Rerror, Tag: tag},
+		Ename:  err.Error(),
+	}
+}
+
+// NewConn creates a new client connection
+func (s *Server) NewConn() go9p.Conn {
+	return &Conn{
+		srv:  s,
+		id:   s.lastID.Add(1),
+		fids: make(map[uint32]*fidInfo),
+		size: proto.MaxMsgLen,
+	}
+}
+
+// Version negotiates protocol version and message size
+func (s *Server) Version(gc go9p.Conn, t *proto.TRVersion) (proto.FCall, error) {
+	c := gc.(*Conn)
+	reply := *t
+	reply.Type = proto.Rversion
+	if !strings.HasPrefix(t.Version, "9P2000") {
+		reply.Version = "unknown"
+		return &reply, nil
+	}
+	reply.Version = "9P2000"
+	reply.Msize = min(t.Msize, proto.MaxMsgLen)
+	c.size = reply.Msize
+	return &reply, nil
+}
+
+// Auth is not supported
+func (s *Server) Auth(gc go9p.Conn, t *proto.TAuth) (proto.FCall, error) {
+	return rerror(t.Tag, ErrNoAuth), nil
+}
+
+// Attach a client to the root of the namespace
+func (s *Server) Attach(gc go9p.Conn, t *proto.TAttach) (proto.FCall, error) {
+	c := gc.(*Conn)
+	if _, ok := c.fid(t.Fid); ok {
+		return rerror(t.Tag, ErrInUse), nil
+	}
+	slog.Debug("attached", "user", t.Uname)
+	c.setFid(t.Fid, &fidInfo{node: s.root, user: t.Uname, mode: proto.None})
+	return &proto.RAttach{
+		Header: proto.Header{Type: proto.Rattach, Tag: t.Tag},
+		Qid:    s.root.Stat().Qid,
+	}, nil
+}
+
+// Walk to a node in the namespace
+func (s *Server) Walk(gc go9p.Conn, t *proto.TWalk) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.fid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	if info.mode != proto.None {
+		return rerror(t.Tag, ErrInUse), nil
+	}
+	node := info.node
+	qids := make([]proto.Qid, 0, len(t.Wname))
+	for _, name := range t.Wname {
+		dir, ok := node.(fs.Dir)
+		if !ok {
+			break
+		}
+		if name == ".." {
+			if p := dir.Parent(); p != nil {
+				node = p
+			}
+		} else if node, ok = dir.Children()[name]; !ok {
+			break
+		}
+		qids = append(qids, node.Stat().Qid)
+	}
+	if len(qids) < len(t.Wname) {
+		if len(qids) == 0 {
+			return rerror(t.Tag, ErrNotExist), nil
+		}
+		// partial walk: newfid is not affected
+		return &proto.RWalk{
+			Header: proto.Header{Type: proto.Rwalk, Tag: t.Tag},
+			Nwqid:  uint16(len(qids)),
+			Wqid:   qids,
+		}, nil
+	}
+	if t.Newfid != t.Fid {
+		if _, ok := c.fid(t.Newfid); ok {
+			return rerror(t.Tag, ErrInUse), nil
+		}
+	}
+	c.setFid(t.Newfid, &fidInfo{node: node, user: info.user, mode: proto.None})
+	return &proto.RWalk{
+		Header: proto.Header{Type: proto.Rwalk, Tag: t.Tag},
+		Nwqid:  uint16(len(qids)),
+		Wqid:   qids,
+	}, nil
+}
+
+// Open a node for reading and/or writing
+func (s *Server) Open(gc go9p.Conn, t *proto.TOpen) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.fid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	if info.mode != proto.None {
+		return rerror(t.Tag, ErrInUse), nil
+	}
+	if !s.access.Permit(info.node, info.user, t.Mode) {
+		return rerror(t.Tag, ErrPerm), nil
+	}
+	switch n := info.node.(type) {
+	case fs.File:
+		fid := c.connFid(t.Fid)
+		s.users.Store(fid, info.user)
+		if err := n.Open(fid, t.Mode); err != nil {
+			s.users.Delete(fid)
+			return rerror(t.Tag, err), nil
+		}
+	case fs.Dir:
+		if t.Mode&3 != proto.Oread && t.Mode&3 != proto.Oexec {
+			return rerror(t.Tag, ErrIsDir), nil
+		}
+		info.dir = sortedChildren(n)
+	}
+	info.mode = t.Mode
+	return &proto.ROpen{
+		Header: proto.Header{Type: proto.Ropen, Tag: t.Tag},
+		Qid:    info.node.Stat().Qid,
+		Iounit: 0,
+	}, nil
+}
+
+// Create a new file in a directory; the fid refers to the new (open)
+// file afterwards.
+func (s *Server) Create(gc go9p.Conn, t *proto.TCreate) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.fid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	if info.mode != proto.None {
+		return rerror(t.Tag, ErrInUse), nil
+	}
+	dir, ok := info.node.(fs.Dir)
+	if !ok || s.CreateFile == nil || !s.access.Permit(dir, info.user, proto.Owrite) {
+		return rerror(t.Tag, ErrPerm), nil
+	}
+	fid := c.connFid(t.Fid)
+	mode := proto.Mode(t.Mode)
+	s.users.Store(fid, info.user)
+	f, err := s.CreateFile(dir, fid, t.Name, info.user, t.Perm, mode)
+	if err != nil {
+		s.users.Delete(fid)
+		return rerror(t.Tag, err), nil
+	}
+	c.setFid(t.Fid, &fidInfo{node: f, user: info.user, mode: mode})
+	return &proto.RCreate{
+		Header: proto.Header{Type: proto.Rcreate, Tag: t.Tag},
+		Qid:    f.Stat().Qid,
+		Iounit: 0,
+	}, nil
+}
+
+// Read from an open node
+func (s *Server) Read(gc go9p.Conn, t *proto.TRead) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.fid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	if m := info.mode & 3; info.mode == proto.None || m == proto.Owrite {
+		return rerror(t.Tag, ErrPerm), nil
+	}
+	count := min(t.Count, c.size-rreadHdrSize)
+	var data []byte
+	switch n := info.node.(type) {
+	case fs.File:
+		var err error
+		if cr, ok := n.(ContextReader); ok {
+			data, err = cr.ReadContext(c.context(t.Tag), c.connFid(t.Fid), t.Offset, uint64(count))
+		} else {
+			data, err = n.Read(c.connFid(t.Fid), t.Offset, uint64(count))
+		}
+		if err != nil {
+			return rerror(t.Tag, err), nil
+		}
+	case fs.Dir:
+		data = readDir(info.dir, t.Offset, count)
+	}
+	return &proto.RRead{
+		Header: proto.Header{Type: proto.Rread, Tag: t.Tag},
+		Count:  uint32(len(data)),
+		Data:   data,
+	}, nil
+}
+
+// read directory entries starting at offset
+func readDir(list []fs.FSNode, ofs uint64, count uint32) (data []byte) {
+	pos := uint64(0)
+	for _, n := range list {
+		st := n.Stat()
+		size := uint64(st.ComposeLength())
+		if pos >= ofs {
+			if uint64(len(data))+size > uint64(count) {
+				break
+			}
+			data = append(data, st.Compose()...)
+		}
+		pos += size
+	}
+	return
+}
+
+// sorted list of directory entries
+func sortedChildren(d fs.Dir) []fs.FSNode {
+	children := d.Children()
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	list := make([]fs.FSNode, len(names))
+	for i, name := range names {
+		list[i] = children[name]
+	}
+	return list
+}
+
+// Write to an open file
+func (s *Server) Write(gc go9p.Conn, t *proto.TWrite) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.fid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	if m := info.mode & 3; info.mode == proto.None || (m != proto.Owrite && m != proto.Ordwr) {
+		return rerror(t.Tag, ErrPerm), nil
+	}
+	f, ok := info.node.(fs.File)
+	if !ok {
+		return rerror(t.Tag, ErrIsDir), nil
+	}
+	n, err := f.Write(c.connFid(t.Fid), t.Offset, t.Data)
+	if err != nil {
+		return rerror(t.Tag, err), nil
+	}
+	return &proto.RWrite{
+		Header: proto.Header{Type: proto.Rwrite, Tag: t.Tag},
+		Count:  n,
+	}, nil
+}
+
+// Clunk a fid (closing an open file)
+func (s *Server) Clunk(gc go9p.Conn, t *proto.TClunk) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.dropFid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	if err := s.close(c, t.Fid, info); err != nil {
+		return rerror(t.Tag, err), nil
+	}
+	return &proto.RClunk{
+		Header: proto.Header{Type: proto.Rclunk, Tag: t.Tag},
+	}, nil
+}
+
+// close an open file
+func (s *Server) close(c *Conn, fid uint32, info *fidInfo) error {
+	f, ok := info.node.(fs.File)
+	if !ok || info.mode == proto.None {
+		return nil
+	}
+	cfid := c.connFid(fid)
+	defer s.users.Delete(cfid)
+	return f.Close(cfid)
+}
+
+// Remove a node; the fid is clunked in any case.
+func (s *Server) Remove(gc go9p.Conn, t *proto.TRemove) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.dropFid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	s.close(c, t.Fid, info)
+	dir := info.node.Parent()
+	if s.RemoveFile == nil || dir == nil || !s.access.Permit(dir, info.user, proto.Owrite) {
+		return rerror(t.Tag, ErrPerm), nil
+	}
+	if err := s.RemoveFile(info.node, info.user); err != nil {
+		return rerror(t.Tag, err), nil
+	}
+	return &proto.RRemove{
+		Header: proto.Header{Type: proto.Rremove, Tag: t.Tag},
+	}, nil
+}
+
+// Stat returns the status of a node
+func (s *Server) Stat(gc go9p.Conn, t *proto.TStat) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.fid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	return &proto.RStat{
+		Header: proto.Header{Type: proto.Rstat, Tag: t.Tag},
+		Stat:   info.node.Stat(),
+	}, nil
+}
+
+// Wstat changes the status of a node: only requests that change nothing
+// (or just the length of a writable file) are accepted.
+func (s *Server) Wstat(gc go9p.Conn, t *proto.TWstat) (proto.FCall, error) {
+	c := gc.(*Conn)
+	info, ok := c.fid(t.Fid)
+	if !ok {
+		return rerror(t.Tag, ErrBadFid), nil
+	}
+	st := &t.Stat
+	if len(st.Name) > 0 || len(st.Uid) > 0 || len(st.Gid) > 0 ||
+		st.Mode != math.MaxUint32 || st.Mtime != math.MaxUint32 {
+		return rerror(t.Tag, ErrPerm), nil
+	}
+	if st.Length != math.MaxUint64 && !s.access.Permit(info.node, info.user, proto.Owrite) {
+		return rerror(t.Tag, ErrPerm), nil
+	}
+	return &proto.RWstat{
+		Header: proto.Header{Type: proto.Rwstat, Tag: t.Tag},
+	}, nil
+}
@@ -0,0 +1,247 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// rawConn is a 9P connection for protocol-level tests
+type rawConn struct {
+	t       *testing.T
+	c       net.Conn
+	replies chan proto.FCall
+}
+
+// newRawConn connects to the plumber service
+func newRawConn(t *testing.T, p *Plumber) *rawConn {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Serve(c1, c1, p.srv)
+		close(done)
+	}()
+	rc := &rawConn{t: t, c: c2, replies: make(chan proto.FCall, 8)}
+	go func() {
+		defer close(rc.replies)
+		for {
+			fc, err := proto.ParseCall(c2)
+			if err != nil {
+				return
+			}
+			rc.replies <- fc
+		}
+	}()
+	t.Cleanup(func() {
+		c2.Close()
+		<-done
+	})
+	return rc
+}
+
+// dialRaw connects to the plumber service and opens a port for reading
+// (on fid 1).
+func dialRaw(t *testing.T, p *Plumber, port string) *rawConn {
+	t.Helper()
+	rc := newRawConn(t, p)
+	rc.rpc(&proto.TRVersion{Header: proto.Header{Type: proto.Tversion, Tag: 0xffff}, Msize: 8192, Version: "9P2000"})
+	rc.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach}, Fid: 0, Afid: ^uint32(0), Uname: "glenda"})
+	rc.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk}, Fid: 0, Newfid: 1, Nwname: 1, Wname: []string{port}})
+	rc.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen}, Fid: 1, Mode: proto.Oread})
+	return rc
+}
+
+// send a request
+func (rc *rawConn) send(fc proto.FCall) {
+	rc.t.Helper()
+	if _, err := rc.c.Write(fc.Compose()); err != nil {
+		rc.t.Fatal(err)
+	}
+}
+
+// reply waits for the next reply
+func (rc *rawConn) reply() proto.FCall {
+	rc.t.Helper()
+	select {
+	case fc, ok := <-rc.replies:
+		if !ok {
+			rc.t.Fatal("connection closed")
+		}
+		return fc
+	case <-time.After(2 * time.Second):
+		rc.t.Fatal("timeout")
+	}
+	return nil
+}
+
+// rpc sends a request and waits for a (successful) reply
+func (rc *rawConn) rpc(fc proto.FCall) proto.FCall {
+	rc.t.Helper()
+	rc.send(fc)
+	resp := rc.reply()
+	if e, ok := resp.(*proto.RError); ok {
+		rc.t.Fatalf("%s: %s", fc, e.Ename)
+	}
+	return resp
+}
+
+// read request on fid 1
+func tread(tag uint16) *proto.TRead {
+	return &proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: tag}, Fid: 1, Count: 8192}
+}
+
+// wait until the port has the given number of readers
+func awaitReaders(t *testing.T, p *Plumber, port string, n int) {
+	t.Helper()
+	for range 200 {
+		if p.port(port).Readers() == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("port '%s' has %d readers, expected %d", port, p.port(port).Readers(), n)
+}
+
+func TestServeFlush(t *testing.T) {
+	p := newPortPlumber(t, "")
+	rc := dialRaw(t, p, "edit")
+
+	// a flushed read is cancelled and not answered
+	rc.send(tread(1))
+	rc.send(&proto.TFlush{Header: proto.Header{Type: proto.Tflush, Tag: 2}, Oldtag: 1})
+	if fc := rc.reply(); fc.GetTag() != 2 {
+		t.Fatalf("expected Rflush, got %s", fc)
+	}
+	// the reader is still attached and gets the next message
+	awaitReaders(t, p, "edit", 1)
+	msg := lib.NewMessage("plumb", "", "/usr/glenda", "text", "main.go")
+	if err := plumb(dial(t, p, "glenda"), p.Pack(msg)); err != nil {
+		t.Fatal(err)
+	}
+	r, ok := rc.rpc(tread(1)).(*proto.RRead)
+	if !ok || !strings.Contains(string(r.Data), "main.go") {
+		t.Fatalf("read after flush: %v", r)
+	}
+}
+
+// completingSrv answers reads only after they are flushed, like a read
+// that took a message just before the flush arrived
+type completingSrv struct {
+	*Server
+}
+
+func (s completingSrv) Read(gc go9p.Conn, t *proto.TRead) (proto.FCall, error) {
+	<-gc.(*Conn).context(t.Tag).Done()
+	return &proto.RRead{Header: proto.Header{Type: proto.Rread, Tag: t.Tag}, Count: 4, Data: []byte("data")}, nil
+}
+
+func TestServeFlushCompleted(t *testing.T) {
+	p := newPortPlumber(t, "")
+	p.srv = completingSrv{p.server}
+	rc := dialRaw(t, p, "edit")
+
+	// a read completed despite the flush is answered before the flush
+	rc.send(tread(1))
+	rc.send(&proto.TFlush{Header: proto.Header{Type: proto.Tflush, Tag: 2}, Oldtag: 1})
+	if r, ok := rc.reply().(*proto.RRead); !ok || r.Tag != 1 || string(r.Data) != "data" {
+		t.Fatalf("expected Rread, got %v", r)
+	}
+	if fc := rc.reply(); fc.GetTag() != 2 {
+		t.Fatalf("expected Rflush, got %s", fc)
+	}
+}
+
+func TestServeClunk(t *testing.T) {
+	p := newPortPlumber(t, "")
+	rc := dialRaw(t, p, "edit")
+
+	// clunking the fid ends a blocked read (EOF); if the clunk wins the
+	// race, the read fails.
+	rc.send(tread(1))
+	rc.send(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 2}, Fid: 1})
+	for range 2 {
+		switch fc := rc.reply().(type) {
+		case *proto.RRead:
+			if fc.Count != 0 {
+				t.Fatalf("read after clunk: %v", fc)
+			}
+		case *proto.RError:
+			if fc.Tag != 1 {
+				t.Fatalf("clunk failed: %s", fc.Ename)
+			}
+		case *proto.RClunk:
+		default:
+			t.Fatalf("unexpected reply %s", fc)
+		}
+	}
+	awaitReaders(t, p, "edit", 0)
+}
+
+func TestServeDisconnect(t *testing.T) {
+	p := newPortPlumber(t, "")
+	for range 3 {
+		// a client waiting for a message goes away: its read is
+		// cancelled and the (single reader) port is released.
+		rc := dialRaw(t, p, "edit")
+		rc.send(tread(1))
+		awaitReaders(t, p, "edit", 1)
+		rc.c.Close()
+		awaitReaders(t, p, "edit", 0)
+	}
+	// a message posted now is kept for the next reader
+	reader := openPorts(t, p, "edit", 1)[0]
+	res := readAsync(reader, 8192)
+	msg := lib.NewMessage("plumb", "", "/usr/glenda", "text", "main.go")
+	if err := plumb(dial(t, p, "glenda"), p.Pack(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if got := await(t, res); !strings.Contains(got, "main.go") {
+		t.Fatalf("read after disconnect: %q", got)
+	}
+}
+
+func TestServeSnoopDisconnect(t *testing.T) {
+	p := newPortPlumber(t, "")
+	rc := dialRaw(t, p, "snoop")
+	rc.send(tread(1))
+	for range 200 {
+		if p.snoop.Active() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rc.c.Close()
+	for range 200 {
+		if !p.snoop.Active() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("snoop reader not released")
+}
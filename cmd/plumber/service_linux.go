@@ -23,37 +23,160 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
-	"github.com/bfix/gospel/logger"
+	"9fans.net/go/plan9/client"
 	"github.com/knusbaum/go9p"
 )
 
-// RunService (on Linux)
-func (p *Plumber) Run() {
-	go func() {
-		if err := go9p.Serve("0.0.0.0:3124", p.srv); err != nil {
-			logger.Println(logger.CRITICAL, "can't start service: "+err.Error())
-		}
-	}()
-
-	// handle OS signals
+// RunService (on Linux) until terminated by a signal. Returns the exit
+// status of the plumber.
+func (p *Plumber) Run() int {
+	// handle OS signals (from now on)
 	sigCh := make(chan os.Signal, 5)
 	signal.Notify(sigCh)
+	defer signal.Stop(sigCh)
+
+	if err := p.listen(); err != nil {
+		Ready(err)
+		logCritical("can't start service", "error", err)
+		p.Shutdown()
+		return ExitError
+	}
+	// rules are loaded, the namespace is built and we are listening:
+	// tell the service manager (or the parent process).
+	Ready(nil)
+	if err := Notify("READY=1"); err != nil {
+		slog.Warn("can't notify service manager", "error", err)
+	}
+
+	// reload rules on changes
+	stop := make(chan struct{})
+	defer close(stop)
+	if p.Watch > 0 {
+		p.WatchRules(p.Watch, stop)
+	}
+
 loop:
 	for sig := range sigCh {
 		switch sig {
 		case syscall.SIGKILL, syscall.SIGINT, syscall.SIGTERM:
-			logger.Printf(logger.INFO, "Terminating service (on signal '%s')\n", sig)
+			slog.Info("terminating service", "signal", sig.String())
 			break loop
 		case syscall.SIGHUP:
-			logger.Println(logger.INFO, "SIGHUP")
+			slog.Info("reloading plumbing file", "signal", sig.String())
+			if err := p.Reload(); err != nil {
+				slog.Error("reload failed (keeping active rules)", "error", err)
+			}
 		case syscall.SIGURG:
 			// TODO: https://github.com/golang/go/issues/37942
 		default:
-			logger.Println(logger.INFO, "Unhandled signal: "+sig.String())
+			slog.Info("unhandled signal", "signal", sig.String())
+		}
+	}
+	Notify("STOPPING=1")
+	return p.Shutdown()
+}
+
+// listen on all configured addresses and serve 9P on accepted
+// connections. If the plumber is started by systemd with sockets
+// (socket activation), the passed sockets are used instead: sockets
+// named "tls" serve TLS clients, all others serve plain 9P.
+func (p *Plumber) listen() error {
+	activated, err := ActivatedListeners()
+	if err != nil {
+		return err
+	}
+	if len(activated) > 0 {
+		for _, al := range activated {
+			slog.Info("using socket", "name", al.Name, "addr", al.L.Addr().String())
+			l := p.life.Listen(al.L)
+			if al.Name == "tls" {
+				if p.Remote == nil {
+					return errors.New("TLS socket passed, but TLS not configured")
+				}
+				go p.serveTLS(tls.NewListener(l, p.Remote.Config()))
+				continue
+			}
+			go p.serve(l, p.srv)
+		}
+		return p.serveMetrics()
+	}
+	if p.Compat {
+		// post service where plan9port clients look for it
+		l, err := listenUnix(filepath.Join(client.Namespace(), "plumb"))
+		if err != nil {
+			return err
+		}
+		go p.serve(p.life.Listen(l), p.srv)
+	}
+	if len(p.Addr) > 0 {
+		l, err := net.Listen("tcp", p.Addr)
+		if err != nil {
+			return err
+		}
+		go p.serve(p.life.Listen(l), p.srv)
+	}
+	if p.Remote != nil {
+		l, err := net.Listen("tcp", p.Remote.Addr)
+		if err != nil {
+			return err
+		}
+		go p.serveTLS(tls.NewListener(p.life.Listen(l), p.Remote.Config()))
+	}
+	return p.serveMetrics()
+}
+
+// serve authenticated 9P on accepted TLS connections
+func (p *Plumber) serveTLS(l net.Listener) {
+	if err := p.Remote.Serve(l, p.srv); !errors.Is(err, net.ErrClosed) {
+		logCritical("TLS service failed", "error", err)
+	}
+}
+
+// listen on a Unix socket; a stale socket (left over from a previous
+// run) is removed.
+func listenUnix(fname string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return nil, err
+	}
+	if c, err := net.Dial("unix", fname); err == nil {
+		c.Close()
+		return nil, errors.New("service already running at " + fname)
+	}
+	os.Remove(fname)
+	return net.Listen("unix", fname)
+}
+
+// serve 9P on accepted (unauthenticated) connections
+func (p *Plumber) serve(l net.Listener, srv go9p.Srv) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logCritical("service failed", "error", err)
+			}
+			return
 		}
+		go func() {
+			defer c.Close()
+			// the user name sent on attach is not trusted: clients
+			// are identified by their local user (or are anonymous).
+			user, ok := PeerUser(c)
+			if !ok {
+				user = Anonymous
+			}
+			if err := Serve(bufio.NewReader(c), c, &userSrv{srv, user}); err != nil {
+				slog.Debug("connection closed", "addr", c.RemoteAddr().String(), "error", err)
+			}
+		}()
 	}
 }
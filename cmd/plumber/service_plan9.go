@@ -22,9 +22,64 @@
 
 package main
 
-import "github.com/knusbaum/go9p"
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"syscall"
 
-// RunService (on Plan9)
-func (p *Plumber) Run() {
-	go9p.PostSrv("plumb", p.srv)
+	"github.com/knusbaum/go9p/proto"
+)
+
+// open mode: remove file on close (ORCLOSE)
+const oRclose = 64
+
+// RunService (on Plan9). Returns the exit status of the plumber.
+func (p *Plumber) Run() int {
+	if p.Watch > 0 {
+		p.WatchRules(p.Watch, nil)
+	}
+	f, srv, err := postSrv("plumb")
+	if err != nil {
+		Ready(err)
+		logCritical("can't post service", "error", err)
+		return ExitError
+	}
+	defer srv.Close()
+	defer f.Close()
+	if err = p.serveMetrics(); err != nil {
+		Ready(err)
+		logCritical("can't serve metrics", "error", err)
+		return ExitError
+	}
+	Ready(nil)
+	// requests are read in one piece (pipes preserve message boundaries)
+	if err = Serve(bufio.NewReaderSize(f, proto.MaxMsgLen), f, p.srv); err != nil && err != io.EOF {
+		slog.Error("service failed", "error", err)
+	}
+	return p.Shutdown()
+}
+
+// postSrv posts one end of a pipe as service in /srv and returns the
+// other end. The service is removed when the returned handle of the
+// service file is closed.
+func postSrv(name string) (pipe, srv *os.File, err error) {
+	f1, f2, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f2.Close()
+	srv, err = os.OpenFile("/srv/"+name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|oRclose|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		f1.Close()
+		return nil, nil, err
+	}
+	if _, err = fmt.Fprintf(srv, "%d", f2.Fd()); err != nil {
+		srv.Close()
+		f1.Close()
+		return nil, nil, err
+	}
+	return f1, srv, nil
 }
@@ -0,0 +1,269 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Exit status of the plumber
+const (
+	ExitOK     = 0 // orderly shutdown
+	ExitError  = 1 // service failed
+	ExitForced = 2 // shutdown incomplete after grace period
+)
+
+// time for pending replies on shutdown
+const linger = 100 * time.Millisecond
+
+// ErrShutdown is returned for requests during shutdown
+var ErrShutdown = errors.New("plumber is shutting down")
+
+// lifecycle keeps track of everything that needs to be stopped or
+// drained on shutdown: listeners, client connections, messages in
+// evaluation and started programs.
+type lifecycle struct {
+	closing   chan struct{}          // closed when shutdown starts
+	stopping  bool                   // shutdown in progress
+	listeners []net.Listener         // active listeners
+	conns     map[net.Conn]struct{}  // active client connections
+	children  map[*exec.Cmd]struct{} // running programs
+	busy      sync.WaitGroup         // messages in evaluation
+	procs     sync.WaitGroup         // running programs
+
+	sync.Mutex
+}
+
+// newLifecycle for a new plumber
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		closing:  make(chan struct{}),
+		conns:    make(map[net.Conn]struct{}),
+		children: make(map[*exec.Cmd]struct{}),
+	}
+}
+
+// Closing returns a channel that is closed when shutdown starts
+func (lc *lifecycle) Closing() <-chan struct{} {
+	return lc.closing
+}
+
+// enter starts the evaluation of a message; returns false on shutdown.
+// Each successful call must be followed by a call to leave().
+func (lc *lifecycle) enter() bool {
+	lc.Lock()
+	defer lc.Unlock()
+	if lc.stopping {
+		return false
+	}
+	lc.busy.Add(1)
+	return true
+}
+
+// leave ends the evaluation of a message
+func (lc *lifecycle) leave() {
+	lc.busy.Done()
+}
+
+// Listen registers a listener; accepted connections are tracked so they
+// can be closed on shutdown.
+func (lc *lifecycle) Listen(l net.Listener) net.Listener {
+	lc.Lock()
+	defer lc.Unlock()
+	lc.listeners = append(lc.listeners, l)
+	return &trackedListener{l, lc}
+}
+
+// trackedListener registers accepted connections
+type trackedListener struct {
+	net.Listener
+	lc *lifecycle
+}
+
+// Accept a new connection
+func (l *trackedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.lc.Lock()
+	defer l.lc.Unlock()
+	if l.lc.stopping {
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	tc := &trackedConn{Conn: c, lc: l.lc}
+	l.lc.conns[tc] = struct{}{}
+	return tc, nil
+}
+
+// trackedConn unregisters on close
+type trackedConn struct {
+	net.Conn
+	lc   *lifecycle
+	once sync.Once
+}
+
+// NetConn returns the underlying connection
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Close connection
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.lc.Lock()
+		delete(c.lc.conns, c)
+		c.lc.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// Start a program; the program is supervised until it terminates. The
+// function 'done' is called with the result of the program.
+func (lc *lifecycle) Start(cmd *exec.Cmd, done func(error)) error {
+	lc.Lock()
+	defer lc.Unlock()
+	if lc.stopping {
+		return ErrShutdown
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	lc.children[cmd] = struct{}{}
+	lc.procs.Add(1)
+	go func() {
+		err := cmd.Wait()
+		lc.Lock()
+		delete(lc.children, cmd)
+		lc.Unlock()
+		lc.procs.Done()
+		done(err)
+	}()
+	return nil
+}
+
+// wait for a wait group with timeout; returns false on timeout
+func waitFor(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Shutdown the plumber service:
+//   - listeners are closed (no new connections),
+//   - messages in evaluation are finished (within the grace period),
+//   - blocked readers on ports are woken up with EOF,
+//   - started programs are waited for (within the grace period) or, if
+//     requested, terminated (and killed after the grace period),
+//   - client connections are closed.
+//
+// Returns the exit status for the plumber.
+func (p *Plumber) Shutdown() int {
+	lc := p.life
+	status := ExitOK
+
+	// stop accepting connections and messages
+	lc.Lock()
+	if lc.stopping {
+		lc.Unlock()
+		return status
+	}
+	lc.stopping = true
+	for _, l := range lc.listeners {
+		l.Close()
+	}
+	lc.Unlock()
+
+	// finish current evaluations (ports are still served), then wake up
+	// blocked readers and deliveries.
+	if !waitFor(&lc.busy, p.Grace) {
+		slog.Warn("shutdown: evaluations still pending")
+		status = ExitForced
+	}
+	close(lc.closing)
+	if !waitFor(&lc.busy, time.Second) {
+		slog.Error("shutdown: evaluations abandoned")
+	}
+	if p.pool != nil {
+		p.pool.Stop()
+	}
+
+	// started programs (editors, browsers, ...) belong to the user: they
+	// keep running (without waiting for them) unless they should be
+	// terminated.
+	if !p.Terminate {
+		lc.Lock()
+		if n := len(lc.children); n > 0 {
+			slog.Info("shutdown: started programs keep running", "count", n)
+		}
+		lc.Unlock()
+	} else {
+		lc.Lock()
+		for cmd := range lc.children {
+			slog.Info("shutdown: terminating program", "cmd", cmd.String(), "pid", cmd.Process.Pid)
+			if err := terminate(cmd.Process); err != nil {
+				slog.Warn("shutdown: can't terminate program", "cmd", cmd.String(), "pid", cmd.Process.Pid, "error", err)
+			}
+		}
+		lc.Unlock()
+		if !waitFor(&lc.procs, p.Grace) {
+			lc.Lock()
+			for cmd := range lc.children {
+				slog.Warn("shutdown: killing program", "cmd", cmd.String(), "pid", cmd.Process.Pid)
+				cmd.Process.Kill()
+			}
+			lc.Unlock()
+			status = ExitForced
+		}
+	}
+
+	// drop client connections (after pending replies had a chance to be
+	// sent: 9P replies are written asynchronously)
+	time.Sleep(linger)
+	lc.Lock()
+	conns := make([]net.Conn, 0, len(lc.conns))
+	for c := range lc.conns {
+		conns = append(conns, c)
+	}
+	lc.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	if err := p.History.Close(); err != nil {
+		slog.Error("shutdown: can't close history file", "error", err)
+	}
+	slog.Info("shutdown complete", "status", status)
+	return status
+}
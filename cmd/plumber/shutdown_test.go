@@ -0,0 +1,164 @@
+//go:build linux
+
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// dial a plumber served on a TCP listener
+func dialTCP(t *testing.T, p *Plumber) (*client.Client, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.serve(p.life.Listen(l), p.srv)
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	cl, err := client.NewClient(c, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cl, c
+}
+
+func TestShutdownReaders(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	cl, conn := dialTCP(t, p)
+	port, err := cl.Open("edit", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := readAsync(port, 8192)
+
+	if status := p.Shutdown(); status != ExitOK {
+		t.Fatalf("exit status %d", status)
+	}
+	// blocked reader gets EOF
+	if got := await(t, res); got != "" && !strings.HasPrefix(got, "error:") {
+		t.Fatalf("unexpected read %q", got)
+	}
+	// connection is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open")
+	}
+	// no more messages are accepted
+	msg := lib.NewMessage("plumb", "", "/", "text", "main.go")
+	if _, err = p.Dispatch(msg); err != ErrShutdown {
+		t.Fatalf("dispatch during shutdown: %v", err)
+	}
+}
+
+func TestShutdownPending(t *testing.T) {
+	p := newPortPlumber(t, "edit queue=1 policy=block timeout=1m\n")
+	p.Grace = 100 * time.Millisecond
+	acme := dial(t, p, "glenda")
+	sender := dial(t, p, "glenda")
+
+	// open port, but don't read: delivery blocks once the queue is full
+	port, err := acme.Open("edit", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	msg := lib.NewMessage("plumb", "", "/", "text", "main.go")
+	if err = plumb(sender, msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan string, 1)
+	go func() {
+		if err := plumb(sender, msg.Pack()); err != nil {
+			sent <- err.Error()
+			return
+		}
+		sent <- "ok"
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if status := p.Shutdown(); status != ExitForced {
+		t.Fatalf("exit status %d", status)
+	}
+	if got := await(t, sent); got != ErrNoRule.Error() {
+		t.Fatalf("pending delivery: %s", got)
+	}
+}
+
+func TestShutdownChildren(t *testing.T) {
+	for _, tc := range []struct {
+		cmd       string
+		terminate bool
+		status    int
+	}{
+		{"sleep 10", false, ExitOK},
+		{"sleep 10", true, ExitOK},
+		{"trap '' TERM; sleep 10", true, ExitForced},
+	} {
+		p := NewPlumber()
+		p.Grace = 200 * time.Millisecond
+		p.Terminate = tc.terminate
+		exited := make(chan string, 1)
+		cmd := exec.Command("sh", "-c", tc.cmd)
+		err := p.life.Start(cmd, func(err error) {
+			exited <- "exited"
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		start := time.Now()
+		if status := p.Shutdown(); status != tc.status {
+			t.Fatalf("'%s': exit status %d", tc.cmd, status)
+		}
+		if !tc.terminate && time.Since(start) >= p.Grace {
+			t.Fatalf("'%s': shutdown waited for running program", tc.cmd)
+		}
+		if !tc.terminate {
+			// the program is left running
+			select {
+			case <-exited:
+				t.Fatalf("'%s' terminated", tc.cmd)
+			default:
+			}
+			cmd.Process.Kill()
+		}
+		await(t, exited)
+
+		// no programs are started after shutdown
+		if err = p.life.Start(exec.Command("true"), func(error) {}); err != ErrShutdown {
+			t.Fatalf("start after shutdown: %v", err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// number of entries queued for a snoop reader
+const snoopBacklog = 64
+
+// SnoopFile ('/mnt/plumb/snoop') is a read-only file that streams an
+// entry for every message received by the plumber together with the
+// outcome of its evaluation. Entries are queued for each reader; if a
+// reader does not keep up, entries are dropped: snooping never blocks
+// the plumber.
+type SnoopFile struct {
+	fs.BaseFile
+
+	plmb    *Plumber                // reference to plumber instance
+	readers map[uint64]*snoopReader // fid-mapped readers
+	dropped atomic.Uint64           // number of dropped entries
+}
+
+// snoopReader is the state of a fid reading snoop entries
+type snoopReader struct {
+	lock    readLock      // serializes reads (guards buf and pos)
+	entries chan []byte   // queued entries
+	done    chan struct{} // closed when the reader closes the file
+	buf     []byte        // current entry
+	pos     int           // read position in current entry
+}
+
+// NewSnoopFile creates a new snoop file
+func NewSnoopFile(s *proto.Stat, plmb *Plumber) *SnoopFile {
+	return &SnoopFile{
+		BaseFile: *fs.NewBaseFile(s),
+		plmb:     plmb,
+		readers:  make(map[uint64]*snoopReader),
+	}
+}
+
+// Active returns true if the snoop file has readers
+func (f *SnoopFile) Active() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.readers) > 0
+}
+
+// Dropped returns the number of entries dropped for slow readers
+func (f *SnoopFile) Dropped() uint64 {
+	return f.dropped.Load()
+}
+
+// Publish an entry to all readers (without blocking)
+func (f *SnoopFile) Publish(entry []byte) {
+	f.RLock()
+	defer f.RUnlock()
+	for _, r := range f.readers {
+		select {
+		case r.entries <- entry:
+		default:
+			f.dropped.Add(1)
+		}
+	}
+}
+
+// Open snoop file for reading
+func (f *SnoopFile) Open(fid uint64, omode proto.Mode) error {
+	if omode&3 != proto.Oread {
+		return ErrPerm
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.readers[fid] = &snoopReader{
+		lock:    newReadLock(),
+		entries: make(chan []byte, snoopBacklog),
+		done:    make(chan struct{}),
+	}
+	return nil
+}
+
+// Read the next entries; offsets are ignored. Reading blocks until an
+// entry is available; returns EOF on shutdown.
+func (f *SnoopFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	return f.ReadContext(context.Background(), fid, ofs, count)
+}
+
+// ReadContext reads the next entries; a read waiting for an entry
+// returns ErrIntr if the context is cancelled.
+func (f *SnoopFile) ReadContext(ctx context.Context, fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	f.RLock()
+	r, ok := f.readers[fid]
+	f.RUnlock()
+	if !ok {
+		return nil, ErrBadFid
+	}
+	if err := r.lock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer r.lock.Unlock()
+	if r.pos >= len(r.buf) {
+		select {
+		case r.buf = <-r.entries:
+			r.pos = 0
+		case <-r.done:
+			return []byte{}, nil
+		case <-f.plmb.life.Closing():
+			return []byte{}, nil
+		case <-ctx.Done():
+			return nil, ErrIntr
+		}
+	}
+	last := min(r.pos+int(count), len(r.buf))
+	data := r.buf[r.pos:last]
+	r.pos = last
+	return data, nil
+}
+
+// Close snoop file
+func (f *SnoopFile) Close(fid uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	if r, ok := f.readers[fid]; ok {
+		close(r.done)
+		delete(f.readers, fid)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------
+
+// snoopRecord collects the outcome of a message evaluation
+type snoopRecord struct {
+	kind    string    // kind of entry ('snoop' or 'test')
+	stamp   time.Time // time the message was received
+	actions []string  // executed 'plumb' actions
+}
+
+// newRecord starts a record of given kind for a received message
+func newRecord(kind string) *snoopRecord {
+	return &snoopRecord{kind: kind, stamp: time.Now()}
+}
+
+// worker wraps a plumbing action to record the executed actions
+func (r *snoopRecord) worker(w lib.NewAction) lib.NewAction {
+	return func() lib.Action {
+		act := w()
+		return func(msg *lib.Message, verb, data string) (ok, done bool) {
+			ok, done = act(msg, verb, data)
+			r.action(verb, data, ok, done)
+			return
+		}
+	}
+}
+
+// action adds an executed action to the record
+func (r *snoopRecord) action(verb, data string, ok, done bool) {
+	r.actions = append(r.actions, fmt.Sprintf("%s %s -> ok=%v, done=%v", verb, data, ok, done))
+}
+
+// entry returns the snoop entry for an evaluated message: a header with
+// the matching ruleset (index and name), the executed actions and the
+// outcome followed by the (rewritten) message.
+func (r *snoopRecord) entry(p *Plumber, msg *lib.Message, ref lib.Ref, delivered bool, err error) []byte {
+	return r.format(p.Pack(msg), ref, delivered, err)
+}
+
+// format a snoop entry for (packed) message data
+func (r *snoopRecord) format(data []byte, ref lib.Ref, delivered bool, err error) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s %s\n", r.kind, r.stamp.Format(time.RFC3339Nano))
+	switch {
+	case ref.Index < 0:
+		buf.WriteString("ruleset none\n")
+	case len(ref.Name) > 0:
+		fmt.Fprintf(buf, "ruleset %d %s\n", ref.Index, ref.Name)
+	default:
+		fmt.Fprintf(buf, "ruleset %d\n", ref.Index)
+	}
+	for _, act := range r.actions {
+		fmt.Fprintf(buf, "action %s\n", act)
+	}
+	fmt.Fprintf(buf, "delivered %v\n", delivered)
+	if err != nil {
+		fmt.Fprintf(buf, "error %s\n", err)
+	}
+	fmt.Fprintf(buf, "message %d\n", len(data))
+	buf.Write(data)
+	return buf.Bytes()
+}
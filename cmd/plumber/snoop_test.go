@@ -0,0 +1,163 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/proto"
+)
+
+func TestSnoop(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	snoop, err := dial(t, p, "glenda").Open("snoop", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snoop.Close()
+	edit := openPorts(t, p, "edit", 1)[0]
+	sender := dial(t, p, "glenda")
+
+	// delivered message
+	res := readAsync(edit, 8192)
+	msg := lib.NewMessage("plumb", "", "/", "text", "main.go")
+	if err = plumb(sender, msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	await(t, res)
+	entry := await(t, readAsync(snoop, 8192))
+	for _, line := range []string{
+		"ruleset 0\n",
+		"action to edit -> ok=true, done=true\n",
+		"delivered true\n",
+		fmt.Sprintf("message %d\n%s", len(msg.Pack()), msg.Pack()),
+	} {
+		if !strings.Contains(entry, line) {
+			t.Fatalf("missing %q in entry %q", line, entry)
+		}
+	}
+	// unmatched message
+	msg = lib.NewMessage("plumb", "", "/", "text", "nothing")
+	plumb(sender, msg.Pack())
+	entry = await(t, readAsync(snoop, 8192))
+	for _, line := range []string{"ruleset none\n", "delivered false\n"} {
+		if !strings.Contains(entry, line) {
+			t.Fatalf("missing %q in entry %q", line, entry)
+		}
+	}
+}
+
+func TestSnoopNamed(t *testing.T) {
+	rules := "ruleset name: go-files\n" + testRules[strings.Index(testRules, "type"):]
+	p := newTestPlumber(t, rules, true)
+	snoop, err := dial(t, p, "glenda").Open("snoop", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snoop.Close()
+	openPorts(t, p, "edit", 1)
+
+	msg := lib.NewMessage("plumb", "", "/", "text", "main.go")
+	if err = plumb(dial(t, p, "glenda"), msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	if entry := await(t, readAsync(snoop, 8192)); !strings.Contains(entry, "ruleset 0 go-files\n") {
+		t.Fatalf("missing ruleset name in entry %q", entry)
+	}
+}
+
+func TestSnoopInvalid(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	snoop, err := dial(t, p, "glenda").Open("snoop", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snoop.Close()
+
+	// the data of an invalid message is published with the error
+	data := []byte("plumb\n\n/\ntext\n\n-1\n")
+	if err = plumb(dial(t, p, "glenda"), data); err == nil {
+		t.Fatal("invalid message accepted")
+	}
+	entry := await(t, readAsync(snoop, 8192))
+	for _, line := range []string{
+		"ruleset none\n",
+		"delivered false\n",
+		"error ",
+		fmt.Sprintf("message %d\n%s", len(data), data),
+	} {
+		if !strings.Contains(entry, line) {
+			t.Fatalf("missing %q in entry %q", line, entry)
+		}
+	}
+}
+
+func TestSnoopAccess(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	if _, err := dial(t, p, "alice").Open("snoop", proto.Oread); err == nil {
+		t.Fatal("snoop opened by other user")
+	}
+}
+
+func TestSnoopNoBlock(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	// snoop reader that doesn't read
+	snoop, err := dial(t, p, "glenda").Open("snoop", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snoop.Close()
+	sender := dial(t, p, "glenda")
+
+	sent := make(chan string, 1)
+	go func() {
+		msg := lib.NewMessage("plumb", "", "/", "text", "nothing")
+		for range 2 * snoopBacklog {
+			plumb(sender, msg.Pack())
+		}
+		sent <- "ok"
+	}()
+	await(t, sent)
+	if n := p.snoop.Dropped(); n != snoopBacklog {
+		t.Fatalf("%d entries dropped", n)
+	}
+}
+
+func TestSnoopConcurrentReads(t *testing.T) {
+	p := newTestPlumber(t, testRules, false)
+	if err := p.snoop.Open(1, proto.Oread); err != nil {
+		t.Fatal(err)
+	}
+	defer p.snoop.Close(1)
+	total := 0
+	for i := range 20 {
+		entry := []byte(fmt.Sprintf("entry %d\n", i))
+		p.snoop.readers[1].entries <- entry
+		total += len(entry)
+	}
+	readConcurrently(t, func(ctx context.Context) ([]byte, error) {
+		return p.snoop.ReadContext(ctx, 1, 0, 3)
+	}, total)
+}
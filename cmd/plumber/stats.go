@@ -0,0 +1,343 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the histogram of
+// evaluation times
+var latencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// Stats are the counters and histograms of the plumber service. Port
+// statistics (drops and readers) are taken from the ports on output.
+type Stats struct {
+	sync.Mutex
+
+	received  uint64            // evaluated messages
+	invalid   uint64            // rejected (invalid) messages
+	errors    uint64            // evaluations that failed
+	unmatched uint64            // messages not handled by a ruleset
+	matches   map[string]uint64 // messages handled per ruleset
+	latency   []uint64          // evaluation times (per bucket)
+	latSum    time.Duration     // total evaluation time
+	delivered map[string]uint64 // deliveries per port
+	started   uint64            // started programs
+	exits     map[int]uint64    // exit codes of started programs
+}
+
+// NewStats creates an empty set of statistics
+func NewStats() *Stats {
+	return &Stats{
+		matches:   make(map[string]uint64),
+		latency:   make([]uint64, len(latencyBuckets)+1),
+		delivered: make(map[string]uint64),
+		exits:     make(map[int]uint64),
+	}
+}
+
+// Observe the evaluation of a message (see lib.Observer)
+func (s *Stats) Observe(in *lib.Message, ref lib.Ref, elapsed time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.received++
+	if err != nil {
+		s.errors++
+	}
+	if ref.Index < 0 {
+		s.unmatched++
+	} else {
+		s.matches[ref.String()]++
+	}
+	i, _ := slices.BinarySearch(latencyBuckets, elapsed.Seconds())
+	s.latency[i]++
+	s.latSum += elapsed
+}
+
+// Invalid counts a rejected message
+func (s *Stats) Invalid() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.invalid++
+}
+
+// Delivered counts a message delivered on a port
+func (s *Stats) Delivered(port string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.delivered[port]++
+}
+
+// Started counts a started program
+func (s *Stats) Started() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.started++
+}
+
+// Exited counts the exit code of a started program (-1 if the program
+// was killed or could not be waited for).
+func (s *Stats) Exited(err error) {
+	if s == nil {
+		return
+	}
+	code := 0
+	if err != nil {
+		code = -1
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			code = ee.ExitCode()
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.exits[code]++
+}
+
+// portCounts are the statistics taken from a port
+type portCounts struct {
+	name    string // port name
+	dropped uint64 // dropped messages
+	readers int    // current readers
+}
+
+// portStats returns the statistics of all ports (sorted by name) without
+// the deliveries (set with the statistics locked).
+func (p *Plumber) portStats() (list []portCounts) {
+	p.pLock.RLock()
+	defer p.pLock.RUnlock()
+	for _, name := range slices.Sorted(maps.Keys(p.ports)) {
+		f := p.ports[name]
+		list = append(list, portCounts{
+			name:    name,
+			dropped: f.Dropped(),
+			readers: f.Readers(),
+		})
+	}
+	return
+}
+
+// Format the statistics as text: one value per line, prefixed by its
+// name and labels.
+func (s *Stats) Format(p *Plumber) []byte {
+	buf := new(bytes.Buffer)
+	if s == nil {
+		return buf.Bytes()
+	}
+	ports := p.portStats()
+	s.Lock()
+	defer s.Unlock()
+	fmt.Fprintf(buf, "received %d\n", s.received)
+	fmt.Fprintf(buf, "invalid %d\n", s.invalid)
+	fmt.Fprintf(buf, "errors %d\n", s.errors)
+	fmt.Fprintf(buf, "unmatched %d\n", s.unmatched)
+	for _, rs := range slices.Sorted(maps.Keys(s.matches)) {
+		fmt.Fprintf(buf, "ruleset %s matched %d\n", rs, s.matches[rs])
+	}
+	var n uint64
+	for i, le := range latencyBuckets {
+		n += s.latency[i]
+		fmt.Fprintf(buf, "latency le %g %d\n", le, n)
+	}
+	n += s.latency[len(latencyBuckets)]
+	fmt.Fprintf(buf, "latency count %d sum %g\n", n, s.latSum.Seconds())
+	for _, ps := range ports {
+		fmt.Fprintf(buf, "port %s delivered %d dropped %d readers %d\n",
+			ps.name, s.delivered[ps.name], ps.dropped, ps.readers)
+	}
+	fmt.Fprintf(buf, "started %d\n", s.started)
+	for _, code := range slices.Sorted(maps.Keys(s.exits)) {
+		fmt.Fprintf(buf, "exit %d %d\n", code, s.exits[code])
+	}
+	return buf.Bytes()
+}
+
+// WritePrometheus writes the statistics in the text format of Prometheus
+func (s *Stats) WritePrometheus(w io.Writer, p *Plumber) {
+	if s == nil {
+		return
+	}
+	ports := p.portStats()
+	s.Lock()
+	defer s.Unlock()
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("plumber_messages_received_total", "counter", "Messages evaluated against the rules.")
+	fmt.Fprintf(w, "plumber_messages_received_total %d\n", s.received)
+	metric("plumber_messages_invalid_total", "counter", "Invalid messages rejected.")
+	fmt.Fprintf(w, "plumber_messages_invalid_total %d\n", s.invalid)
+	metric("plumber_evaluation_errors_total", "counter", "Evaluations that failed.")
+	fmt.Fprintf(w, "plumber_evaluation_errors_total %d\n", s.errors)
+	metric("plumber_messages_unmatched_total", "counter", "Messages not handled by a ruleset.")
+	fmt.Fprintf(w, "plumber_messages_unmatched_total %d\n", s.unmatched)
+	metric("plumber_ruleset_matches_total", "counter", "Messages handled per ruleset.")
+	for _, rs := range slices.Sorted(maps.Keys(s.matches)) {
+		fmt.Fprintf(w, "plumber_ruleset_matches_total{ruleset=\"%s\"} %d\n", escapeLabel(rs), s.matches[rs])
+	}
+	metric("plumber_evaluation_seconds", "histogram", "Time to evaluate a message.")
+	var n uint64
+	for i, le := range latencyBuckets {
+		n += s.latency[i]
+		fmt.Fprintf(w, "plumber_evaluation_seconds_bucket{le=\"%g\"} %d\n", le, n)
+	}
+	n += s.latency[len(latencyBuckets)]
+	fmt.Fprintf(w, "plumber_evaluation_seconds_bucket{le=\"+Inf\"} %d\n", n)
+	fmt.Fprintf(w, "plumber_evaluation_seconds_sum %g\n", s.latSum.Seconds())
+	fmt.Fprintf(w, "plumber_evaluation_seconds_count %d\n", n)
+	metric("plumber_port_deliveries_total", "counter", "Messages delivered per port.")
+	for _, ps := range ports {
+		fmt.Fprintf(w, "plumber_port_deliveries_total{port=\"%s\"} %d\n", escapeLabel(ps.name), s.delivered[ps.name])
+	}
+	metric("plumber_port_drops_total", "counter", "Messages dropped on full queues per port.")
+	for _, ps := range ports {
+		fmt.Fprintf(w, "plumber_port_drops_total{port=\"%s\"} %d\n", escapeLabel(ps.name), ps.dropped)
+	}
+	metric("plumber_port_readers", "gauge", "Current readers per port.")
+	for _, ps := range ports {
+		fmt.Fprintf(w, "plumber_port_readers{port=\"%s\"} %d\n", escapeLabel(ps.name), ps.readers)
+	}
+	metric("plumber_processes_started_total", "counter", "Programs started.")
+	fmt.Fprintf(w, "plumber_processes_started_total %d\n", s.started)
+	metric("plumber_process_exits_total", "counter", "Exit codes of started programs.")
+	for _, code := range slices.Sorted(maps.Keys(s.exits)) {
+		fmt.Fprintf(w, "plumber_process_exits_total{code=\"%d\"} %d\n", code, s.exits[code])
+	}
+}
+
+// escapeLabel escapes a label value for the Prometheus text format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+//----------------------------------------------------------------------
+
+// StatsFile ('/mnt/plumb/stats') is a read-only file listing the
+// statistics of the plumber (as of opening the file).
+type StatsFile struct {
+	fs.BaseFile
+
+	content map[uint64][]byte // fid-mapped statistics (on open)
+	plmb    *Plumber          // reference to plumber instance
+}
+
+// NewStatsFile creates a new statistics file
+func NewStatsFile(s *proto.Stat, plmb *Plumber) *StatsFile {
+	return &StatsFile{
+		BaseFile: *fs.NewBaseFile(s),
+		content:  make(map[uint64][]byte),
+		plmb:     plmb,
+	}
+}
+
+// Open statistics file for reading
+func (f *StatsFile) Open(fid uint64, omode proto.Mode) error {
+	if omode&3 != proto.Oread {
+		return ErrPerm
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.content[fid] = f.plmb.Stats.Format(f.plmb)
+	return nil
+}
+
+// Read statistics (as of opening the file)
+func (f *StatsFile) Read(fid uint64, ofs uint64, count uint64) ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	data := f.content[fid]
+	flen := uint64(len(data))
+	if ofs >= flen {
+		return []byte{}, nil
+	}
+	last := min(ofs+count, flen)
+	return data[ofs:last], nil
+}
+
+// Close statistics file
+func (f *StatsFile) Close(fid uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.content, fid)
+	return nil
+}
+
+//----------------------------------------------------------------------
+
+// serveMetrics serves the statistics over HTTP (Prometheus text format)
+// on the metrics address (if set). The listener is closed on shutdown.
+func (p *Plumber) serveMetrics() error {
+	if len(p.Metrics) == 0 {
+		return nil
+	}
+	l, err := net.Listen("tcp", p.Metrics)
+	if err != nil {
+		return err
+	}
+	slog.Info("serving metrics", "addr", l.Addr().String())
+	go func() {
+		if err := http.Serve(p.life.Listen(l), p.metricsHandler()); !errors.Is(err, net.ErrClosed) {
+			slog.Error("metrics service failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// metricsHandler returns the HTTP handler for the metrics endpoint
+func (p *Plumber) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		p.Stats.WritePrometheus(w, p)
+	})
+	return mux
+}
@@ -0,0 +1,131 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/proto"
+)
+
+func TestStats(t *testing.T) {
+	p := newTestPlumber(t, testRules, true)
+	reader := openPorts(t, p, "edit", 1)[0]
+	cl := dial(t, p, "glenda")
+
+	// a delivered, an unmatched and an invalid message
+	res := readAsync(reader, 8192)
+	if err := plumb(cl, lib.NewMessage("plumb", "", "/", "text", "main.go").Pack()); err != nil {
+		t.Fatal(err)
+	}
+	await(t, res)
+	plumb(cl, lib.NewMessage("plumb", "", "/", "text", "nothing").Pack())
+	if plumb(cl, []byte("plumb\n\n/\ntext\n\n-1\n")) == nil {
+		t.Fatal("invalid message accepted")
+	}
+	// dry-runs are not counted
+	p.Plan(lib.NewMessage("plumb", "", "/", "text", "x.go"))
+
+	f, err := cl.Open("stats", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"received 2\n",
+		"invalid 1\n",
+		"unmatched 1\n",
+		"ruleset 0 matched 1\n",
+		"latency count 2 ",
+		"port edit delivered 1 dropped 0 readers 1\n",
+		"port web delivered 0 dropped 0 readers 0\n",
+	} {
+		if !strings.Contains(string(data), line) {
+			t.Fatalf("missing %q in %q", line, data)
+		}
+	}
+	// the statistics are read-only
+	if _, err = cl.Open("stats", proto.Owrite); err == nil {
+		t.Fatal("stats opened for writing")
+	}
+
+	// metrics in Prometheus format
+	rec := httptest.NewRecorder()
+	p.metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		"# TYPE plumber_messages_received_total counter\n",
+		"plumber_messages_received_total 2\n",
+		"plumber_ruleset_matches_total{ruleset=\"0\"} 1\n",
+		"plumber_evaluation_seconds_bucket{le=\"+Inf\"} 2\n",
+		"plumber_evaluation_seconds_count 2\n",
+		"plumber_port_deliveries_total{port=\"edit\"} 1\n",
+		"plumber_port_readers{port=\"edit\"} 1\n",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Fatalf("missing %q in %q", line, rec.Body.String())
+		}
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	s := NewStats()
+	s.Observe(nil, lib.Ref{Index: 1, Name: "web"}, 2*time.Millisecond, nil)
+	s.Observe(nil, lib.Ref{Index: -1}, 2*time.Second, errors.New("failed"))
+	s.Started()
+	s.Exited(nil)
+	s.Exited(exec.Command("sh", "-c", "exit 3").Run())
+	s.Exited(errors.New("no wait"))
+
+	p := NewPlumber()
+	p.NamespaceService()
+	data := string(s.Format(p))
+	for _, line := range []string{
+		"received 2\n",
+		"errors 1\n",
+		"ruleset web matched 1\n",
+		"latency le 0.001 0\n",
+		"latency le 0.0025 1\n",
+		"latency le 1 1\n",
+		"latency count 2 sum 2.002\n",
+		"started 1\n",
+		"exit -1 1\n",
+		"exit 0 1\n",
+		"exit 3 1\n",
+	} {
+		if !strings.Contains(data, line) {
+			t.Fatalf("missing %q in %q", line, data)
+		}
+	}
+	if escapeLabel("a\"b\\c\n") != `a\"b\\c\n` {
+		t.Fatal("label not escaped")
+	}
+}
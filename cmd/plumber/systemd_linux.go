@@ -0,0 +1,103 @@
+//go:build linux
+
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// first file descriptor passed by systemd (see sd_listen_fds(3))
+const listenFdsStart = 3
+
+// ActivatedListener is a listening socket passed by the service manager
+type ActivatedListener struct {
+	Name string       // name of socket (from LISTEN_FDNAMES)
+	L    net.Listener // listener
+}
+
+// ActivatedListeners returns the listening sockets passed by systemd
+// (socket activation). The environment variables are removed, so the
+// sockets are not passed on to started programs.
+func ActivatedListeners() ([]ActivatedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	num, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || num <= 0 {
+		return nil, nil
+	}
+	return listenersFromFds(listenFdsStart, num, os.Getenv("LISTEN_FDNAMES"))
+}
+
+// listenersFromFds creates listeners from a range of file descriptors.
+// Sockets without a name are named "plumb".
+func listenersFromFds(start, num int, names string) ([]ActivatedListener, error) {
+	nameList := strings.Split(names, ":")
+	list := make([]ActivatedListener, 0, num)
+	for i := range num {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+		name := "plumb"
+		if i < len(nameList) && len(nameList[i]) > 0 {
+			name = nameList[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, al := range list {
+				al.L.Close()
+			}
+			return nil, fmt.Errorf("socket '%s' (fd %d): %w", name, fd, err)
+		}
+		list = append(list, ActivatedListener{name, l})
+	}
+	return list, nil
+}
+
+// Notify the service manager about a state change (see sd_notify(3)),
+// e.g. "READY=1". Nothing is sent if no notification socket is set.
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if len(addr) == 0 {
+		return nil
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
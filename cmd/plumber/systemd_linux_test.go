@@ -0,0 +1,248 @@
+//go:build linux
+
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// fake service manager notification socket
+func notifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "notify"), Net: "unixgram"}
+	c, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// wait for a notification
+func notification(t *testing.T, c *net.UnixConn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 256)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+// awaitState reads notifications of a started plumber until it reports
+// the state. Startup of the plumber (a test binary) can take long on a
+// loaded machine, so the deadline is generous; the wait ends early if
+// the plumber exits (and all its notifications are read).
+func awaitState(t *testing.T, c *net.UnixConn, state string, exited <-chan struct{}) {
+	t.Helper()
+	deadline := time.Now().Add(time.Minute)
+	buf := make([]byte, 256)
+	for time.Now().Before(deadline) {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := c.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Fatal(err)
+			}
+			select {
+			case <-exited:
+				t.Fatalf("plumber exited before %s", state)
+			default:
+			}
+			continue
+		}
+		if string(buf[:n]) == state {
+			return
+		}
+	}
+	t.Fatalf("no %s notification", state)
+}
+
+func TestNotify(t *testing.T) {
+	// no notification socket
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	c := notifySocket(t)
+	t.Setenv("NOTIFY_SOCKET", c.LocalAddr().String())
+	if err := Notify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := notification(t, c); got != "READY=1" {
+		t.Fatalf("got notification %q", got)
+	}
+}
+
+func TestListenersFromFds(t *testing.T) {
+	// place two listening sockets at consecutive descriptors
+	const start = 100
+	for i := range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = syscall.Dup3(int(f.Fd()), start+i, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		l.Close()
+	}
+	list, err := listenersFromFds(start, 2, "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, al := range list {
+			al.L.Close()
+		}
+	}()
+	if len(list) != 2 || list[0].Name != "tls" || list[1].Name != "plumb" {
+		t.Fatalf("unexpected listeners %v", list)
+	}
+	// not a socket
+	f, err := os.CreateTemp(t.TempDir(), "fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Dup3(int(f.Fd()), start+2, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err = listenersFromFds(start+2, 1, ""); err == nil {
+		t.Fatal("file accepted as socket")
+	}
+}
+
+// TestActivation runs a plumber in a child process with an inherited
+// listening socket (as systemd does) and checks the notifications.
+func TestActivation(t *testing.T) {
+	if os.Getenv("PLUMBER_ACTIVATION_HELPER") == "1" {
+		activationHelper()
+		return
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	notify := notifySocket(t)
+
+	// LISTEN_PID must be the pid of the plumber
+	cmd := exec.Command("sh", "-c", `LISTEN_PID=$$ exec "$0" -test.run='^TestActivation$'`, os.Args[0])
+	cmd.Env = append(os.Environ(),
+		"PLUMBER_ACTIVATION_HELPER=1",
+		"LISTEN_FDS=1",
+		"LISTEN_FDNAMES=plumb",
+		"NOTIFY_SOCKET="+notify.LocalAddr().String(),
+	)
+	cmd.ExtraFiles = []*os.File{f}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	l.Close()
+	var exitErr error
+	exited := make(chan struct{})
+	go func() {
+		exitErr = cmd.Wait()
+		close(exited)
+	}()
+	defer func() {
+		cmd.Process.Kill()
+		<-exited
+		if t.Failed() {
+			t.Logf("plumber output:\n%s", stderr.String())
+		}
+	}()
+
+	awaitState(t, notify, "READY=1", exited)
+	// the plumber serves on the inherited socket
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cl, err := client.NewClient(c, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := cl.Open("rules", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "plumb\tto\tedit") {
+		t.Fatalf("unexpected rules %q", content)
+	}
+	rules.Close()
+
+	// orderly shutdown
+	cmd.Process.Signal(syscall.SIGTERM)
+	awaitState(t, notify, "STOPPING=1", exited)
+	select {
+	case <-exited:
+		if exitErr != nil {
+			t.Fatalf("plumber failed: %v", exitErr)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("plumber not terminated")
+	}
+}
+
+// plumber started by TestActivation
+func activationHelper() {
+	p := NewPlumber()
+	p.Dry.Store(true)
+	p.Addr = ""
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(testRules)); err != nil {
+		os.Exit(ExitError)
+	}
+	p.NamespaceService()
+	os.Exit(p.Run())
+}
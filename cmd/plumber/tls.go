@@ -0,0 +1,166 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// TLSService for remote access to the plumber: clients must present a
+// certificate with a known fingerprint; the fingerprint determines the
+// 9P user name of the client. Clients without a known certificate are
+// disconnected before any 9P message is processed.
+type TLSService struct {
+	Addr  string            // listen address
+	Cert  tls.Certificate   // server certificate
+	Users map[string]string // client fingerprint -> 9P user name
+}
+
+// NewTLSService creates a TLS service from certificate/key and user files
+func NewTLSService(addr, certFile, keyFile, usersFile string) (*TLSService, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	users, err := ReadTLSUsers(usersFile)
+	if err != nil {
+		return nil, err
+	}
+	return &TLSService{
+		Addr:  addr,
+		Cert:  cert,
+		Users: users,
+	}, nil
+}
+
+// ReadTLSUsers reads a list of allowed client certificates. Each line
+// holds the SHA-256 fingerprint of a certificate (hex, colons allowed)
+// followed by the 9P user name; empty lines and comments are ignored.
+func ReadTLSUsers(fname string) (map[string]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	rdr := bufio.NewScanner(f)
+	for num := 1; rdr.Scan(); num++ {
+		line := strings.TrimSpace(rdr.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid entry", fname, num)
+		}
+		fp := normalizeFingerprint(parts[0])
+		if len(fp) != 2*sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid fingerprint", fname, num)
+		}
+		users[fp] = parts[1]
+	}
+	return users, rdr.Err()
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate (hex)
+func Fingerprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(h[:])
+}
+
+// normalize fingerprint notation (lower-case hex without colons)
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+}
+
+// Config returns the TLS configuration for the service
+func (s *TLSService) Config() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{s.Cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// User returns the 9P user for an authenticated connection
+func (s *TLSService) User(c *tls.Conn) (string, bool) {
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", false
+	}
+	user, ok := s.Users[Fingerprint(certs[0])]
+	return user, ok
+}
+
+// Serve 9P on accepted TLS connections
+func (s *TLSService) Serve(l net.Listener, srv go9p.Srv) error {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(nc.(*tls.Conn), srv)
+	}
+}
+
+// handle a single client connection
+func (s *TLSService) serveConn(c *tls.Conn, srv go9p.Srv) {
+	defer c.Close()
+	if err := c.Handshake(); err != nil {
+		slog.Warn("TLS handshake failed", "addr", c.RemoteAddr().String(), "error", err)
+		return
+	}
+	user, ok := s.User(c)
+	if !ok {
+		slog.Warn("unknown client certificate", "addr", c.RemoteAddr().String())
+		return
+	}
+	slog.Info("client connected", "addr", c.RemoteAddr().String(), "user", user)
+	if err := Serve(bufio.NewReader(c), c, &userSrv{srv, user}); err != nil {
+		slog.Debug("connection closed", "addr", c.RemoteAddr().String(), "error", err)
+	}
+}
+
+// userSrv is a 9P service for an authenticated user: the user name
+// requested by the client on attach is replaced.
+type userSrv struct {
+	go9p.Srv
+	user string
+}
+
+// Attach as authenticated user
+func (s *userSrv) Attach(c go9p.Conn, t *proto.TAttach) (proto.FCall, error) {
+	t.Uname = s.user
+	return s.Srv.Attach(c, t)
+}
@@ -0,0 +1,231 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// newCert generates a self-signed certificate
+func newCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// writePEM stores certificate and key in files
+func writePEM(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	k := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err = os.WriteFile(certFile, c, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, k, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// start a TLS service for the plumber
+func startTLS(t *testing.T, p *Plumber, users string) string {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := writePEM(t, dir, newCert(t, "localhost"))
+	usersFile := filepath.Join(dir, "users")
+	if err := os.WriteFile(usersFile, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewTLSService("127.0.0.1:0", certFile, keyFile, usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nl, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := tls.NewListener(nl, s.Config())
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l, p.srv)
+	return l.Addr().String()
+}
+
+// dialTLS connects a 9P client with a client certificate
+func dialTLS(addr string, cert *tls.Certificate) (*client.Client, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	c, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := client.NewClient(c, "glenda", "")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return cl, nil
+}
+
+func TestTLSAccess(t *testing.T) {
+	p := newTestPlumber(t, testRules, false)
+	known := newCert(t, "known")
+	unknown := newCert(t, "unknown")
+	addr := startTLS(t, p, "# allowed clients\n"+Fingerprint(known.Leaf)+" glenda\n")
+
+	cl, err := dialTLS(addr, &known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cl.Open("rules", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, cert := range []*tls.Certificate{&unknown, nil} {
+		if !rejected(t, addr, cert) {
+			t.Fatal("unauthorized client accepted")
+		}
+	}
+}
+
+// rejected returns true if the service closes a connection with the given
+// client certificate without serving 9P
+func rejected(t *testing.T, addr string, cert *tls.Certificate) bool {
+	t.Helper()
+	cfg := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	c, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return true
+	}
+	defer c.Close()
+	ver := &proto.TRVersion{
+		Header:  proto.Header{Type: proto.Tversion, Tag: 0xffff},
+		Msize:   8192,
+		Version: "9P2000",
+	}
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err = c.Write(ver.Compose()); err != nil {
+		return true
+	}
+	buf := make([]byte, 1)
+	_, err = c.Read(buf)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("timeout")
+	}
+	return err != nil
+}
+
+// attachSrv records the user name on attach
+type attachSrv struct {
+	go9p.Srv
+	uname string
+}
+
+func (s *attachSrv) Attach(c go9p.Conn, t *proto.TAttach) (proto.FCall, error) {
+	s.uname = t.Uname
+	return &proto.RAttach{Header: proto.Header{Type: proto.Rattach, Tag: t.Tag}}, nil
+}
+
+func TestTLSUserAttach(t *testing.T) {
+	inner := new(attachSrv)
+	srv := &userSrv{inner, "glenda"}
+	srv.Attach(nil, &proto.TAttach{Uname: "adm"})
+	if inner.uname != "glenda" {
+		t.Fatalf("attached as '%s'", inner.uname)
+	}
+}
+
+func TestTLSUsersFile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "users")
+	fp := "AB:" + Fingerprint(newCert(t, "x").Leaf)[2:]
+	if err := os.WriteFile(fname, []byte(fp+" glenda\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ReadTLSUsers(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users[normalizeFingerprint(fp)] != "glenda" {
+		t.Fatal("fingerprint not found")
+	}
+	if err = os.WriteFile(fname, []byte("1234 glenda\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadTLSUsers(fname); err == nil {
+		t.Fatal("invalid fingerprint accepted")
+	}
+}
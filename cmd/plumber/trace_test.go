@@ -0,0 +1,387 @@
+//go:build !plan9
+
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"9fans.net/go/plan9"
+	p9client "9fans.net/go/plan9/client"
+	p9plumb "9fans.net/go/plumb"
+)
+
+// Recorded conversations:
+//
+//   - testdata/compat-*.trace are regression traces: the 9P traffic of
+//     clients using the plumb package of 9fans.net/go against this
+//     plumber (recorded with '-record'). They only detect changes of our
+//     own replies, not differences to plan9port.
+//   - testdata/p9p-*.trace are conformance traces: sessions of real
+//     plan9port clients (acme, plumb(1)) against the plumber of plan9port,
+//     recorded with the proxy of TestRecordProxy. The plan9port plumber
+//     must use the rules in testdata/compat.plumbing.
+//
+// When replayed, the recorded requests are sent to this plumber and the
+// replies are compared with the recorded ones (ignoring qids, times and
+// owners of files).
+
+var (
+	record      = flag.Bool("record", false, "record 9P regression traces of compat clients")
+	proxyListen = flag.String("proxy", "", "record traces of clients connecting to this Unix socket")
+	proxyTarget = flag.String("target", "", "Unix socket of the plan9port plumber (for -proxy)")
+	proxyTrace  = flag.String("trace", "", "trace file written by the proxy (for -proxy)")
+	proxyTime   = flag.Duration("duration", time.Minute, "recording time of the proxy (for -proxy)")
+)
+
+// compatTraces are the recorded client conversations; a conversation
+// gets a function to connect new clients.
+var compatTraces = map[string]func(t *testing.T, p *Plumber, mount func() *p9client.Fsys){
+	// acme reads its port while plumb(1) sends messages
+	"acme": func(t *testing.T, p *Plumber, mount func() *p9client.Fsys) {
+		acme := mount()
+		port, err := acme.Open("edit", plan9.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		awaitReaders(t, p, "edit", 1)
+		msgs := []*p9plumb.Message{
+			{Src: "plumb", Dir: "/usr/glenda/src", Type: "text", Data: []byte("cmd/plumber/main.go"),
+				Attr: &p9plumb.Attribute{Name: "addr", Value: "#42"}},
+			{Src: "acme", Dst: "edit", Dir: "/usr/glenda", Type: "text", Data: []byte("any text\nwith two lines")},
+		}
+		send, err := mount().Open("send", plan9.OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdr := bufio.NewReader(port)
+		for _, msg := range msgs {
+			if err = msg.Send(send); err != nil {
+				t.Fatal(err)
+			}
+			checkRecv(t, rdr, msg)
+		}
+		// messages without matching rule are rejected
+		msg := &p9plumb.Message{Src: "plumb", Dir: "/", Type: "text", Data: []byte("no rule for this")}
+		if err = msg.Send(send); err == nil || err.Error() != ErrNoRule.Error() {
+			t.Fatalf("unexpected error '%v'", err)
+		}
+		send.Close()
+		port.Close()
+	},
+	// every reader of a port gets a copy of a message
+	"broadcast": func(t *testing.T, p *Plumber, mount func() *p9client.Fsys) {
+		var rdrs []*bufio.Reader
+		for range 2 {
+			port, err := mount().Open("web", plan9.OREAD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer port.Close()
+			rdrs = append(rdrs, bufio.NewReader(port))
+		}
+		awaitReaders(t, p, "web", 2)
+		send, err := mount().Open("send", plan9.OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer send.Close()
+		msg := &p9plumb.Message{Src: "plumb", Dir: "/", Type: "text", Data: []byte("https://9p.io/plan9/")}
+		if err = msg.Send(send); err != nil {
+			t.Fatal(err)
+		}
+		for _, rdr := range rdrs {
+			checkRecv(t, rdr, msg)
+		}
+	},
+}
+
+// checkRecv receives a message and compares it with the sent message
+func checkRecv(t *testing.T, rdr *bufio.Reader, sent *p9plumb.Message) {
+	t.Helper()
+	got := new(p9plumb.Message)
+	if err := got.Recv(rdr); err != nil {
+		t.Fatal(err)
+	}
+	if got.Src != sent.Src || got.Dir != sent.Dir || !bytes.Equal(got.Data, sent.Data) {
+		t.Fatalf("received %+v", got)
+	}
+}
+
+func TestCompatTraces(t *testing.T) {
+	for name, conv := range compatTraces {
+		t.Run(name, func(t *testing.T) {
+			fname := filepath.Join("testdata", "compat-"+name+".trace")
+			p := newTestPlumber(t, testRules, true)
+			if *record {
+				recordTrace(t, p, fname, conv)
+				return
+			}
+			replayTrace(t, p, fname)
+		})
+	}
+}
+
+// recorder collects the 9P messages of all connections
+type recorder struct {
+	lines []string
+	sync.Mutex
+}
+
+// add a message sent in given direction ('>' request, '<' reply)
+func (r *recorder) add(conn int, dir string, msg []byte) {
+	r.Lock()
+	defer r.Unlock()
+	desc := "(invalid)"
+	if fc, err := plan9.UnmarshalFcall(msg); err == nil {
+		desc = fc.String()
+	}
+	r.lines = append(r.lines, "# "+desc, fmt.Sprintf("%d%s %x", conn, dir, msg))
+}
+
+// forward 9P messages and record them (before they are forwarded)
+func (r *recorder) forward(conn int, dir string, src io.Reader, dst io.WriteCloser) {
+	defer dst.Close()
+	for {
+		msg, err := read9P(src)
+		if err != nil {
+			return
+		}
+		r.add(conn, dir, msg)
+		if _, err = dst.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// read9P reads a single 9P message
+func read9P(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.LittleEndian.Uint32(size[:]))
+	copy(msg, size[:])
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// recordTrace runs a conversation and writes its trace to a file
+func recordTrace(t *testing.T, p *Plumber, fname string, conv func(*testing.T, *Plumber, func() *p9client.Fsys)) {
+	rec := new(recorder)
+	var wg sync.WaitGroup
+	var conns []io.Closer
+	mount := func() *p9client.Fsys {
+		c1, c2 := net.Pipe()
+		s1, s2 := net.Pipe()
+		conns = append(conns, c2)
+		id := len(conns)
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			Serve(s1, s1, p.srv)
+			s1.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			rec.forward(id, ">", c1, s2)
+		}()
+		go func() {
+			defer wg.Done()
+			rec.forward(id, "<", s2, c1)
+		}()
+		conn, err := p9client.NewConn(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys, err := conn.Attach(nil, "glenda", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsys
+	}
+	conv(t, p, mount)
+	for _, c := range conns {
+		c.Close()
+	}
+	wg.Wait()
+
+	rec.write(t, fname, "9fans.net/go plumb clients against this plumber (see TestCompatTraces)")
+}
+
+// write the recorded messages to a trace file
+func (r *recorder) write(t *testing.T, fname, origin string) {
+	r.Lock()
+	defer r.Unlock()
+	hdr := "# 9P conversation of " + origin + "\n" +
+		"# <conn><direction> <message>; '>' is a request, '<' a reply\n"
+	data := hdr + strings.Join(r.lines, "\n") + "\n"
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fname, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRecordProxy records the sessions of real plan9port clients with
+// the plumber of plan9port. The proxy listens on a Unix socket and
+// forwards all connections to the plan9port plumber, e.g.:
+//
+//	plumber -p testdata/compat.plumbing   # plan9port, posts $NAMESPACE/plumb
+//	mv $NAMESPACE/plumb $NAMESPACE/plumb.p9p
+//	go test -run TestRecordProxy -proxy $NAMESPACE/plumb \
+//	    -target $NAMESPACE/plumb.p9p -trace testdata/p9p-acme.trace
+//
+// and then acme and plumb(1) are used while the proxy is recording.
+func TestRecordProxy(t *testing.T) {
+	if len(*proxyListen) == 0 {
+		t.Skip("no recording proxy requested (-proxy)")
+	}
+	if len(*proxyTarget) == 0 || len(*proxyTrace) == 0 {
+		t.Fatal("-proxy needs -target and -trace")
+	}
+	l, err := net.Listen("unix", *proxyListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(*proxyTime, func() { l.Close() })
+
+	rec := new(recorder)
+	var wg sync.WaitGroup
+	for id := 1; ; id++ {
+		c, err := l.Accept()
+		if err != nil {
+			break
+		}
+		s, err := net.Dial("unix", *proxyTarget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rec.forward(id, ">", c, s.(*net.UnixConn))
+		}()
+		go func() {
+			defer wg.Done()
+			rec.forward(id, "<", s, c.(*net.UnixConn))
+		}()
+	}
+	wg.Wait()
+	rec.write(t, *proxyTrace, "plan9port clients against the plan9port plumber (see TestRecordProxy)")
+}
+
+// TestP9PTraces replays the sessions recorded with the plumber of
+// plan9port (see TestRecordProxy) against this plumber.
+func TestP9PTraces(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "p9p-*.trace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no traces recorded with plan9port (see TestRecordProxy)")
+	}
+	rules, err := os.ReadFile(filepath.Join("testdata", "compat.plumbing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range files {
+		t.Run(filepath.Base(fname), func(t *testing.T) {
+			p := newTestPlumber(t, string(rules), true)
+			replayTrace(t, p, fname)
+		})
+	}
+}
+
+// replayTrace sends the recorded requests and compares the replies
+func replayTrace(t *testing.T, p *Plumber, fname string) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(map[string]*rawConn)
+	for num, line := range strings.Split(string(data), "\n") {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		head, enc, _ := strings.Cut(line, " ")
+		msg, err := hex.DecodeString(enc)
+		if err != nil || len(head) < 2 {
+			t.Fatalf("line %d: invalid entry", num+1)
+		}
+		id, dir := head[:len(head)-1], head[len(head)-1]
+		rc, ok := conns[id]
+		if !ok {
+			rc = newRawConn(t, p)
+			conns[id] = rc
+		}
+		if dir == '>' {
+			if _, err = rc.c.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got, exp := normFcall(rc.reply().Compose()), normFcall(msg)
+		if got != exp {
+			t.Fatalf("line %d: got '%s', expected '%s'", num+1, got, exp)
+		}
+	}
+}
+
+// normFcall returns the description of a 9P message without qids (and
+// without times and owners of files in stat replies): they depend on the
+// server instance.
+func normFcall(msg []byte) string {
+	fc, err := plan9.UnmarshalFcall(msg)
+	if err != nil {
+		return "(invalid) " + err.Error()
+	}
+	fc.Qid = plan9.Qid{}
+	for i := range fc.Wqid {
+		fc.Wqid[i] = plan9.Qid{}
+	}
+	if fc.Type == plan9.Rstat {
+		if d, err := plan9.UnmarshalDir(fc.Stat); err == nil {
+			d.Qid = plan9.Qid{}
+			d.Atime, d.Mtime = 0, 0
+			d.Uid, d.Gid, d.Muid = "", "", ""
+			fc.Stat, _ = d.Bytes()
+		}
+	}
+	return fc.String()
+}
@@ -0,0 +1,80 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"os"
+	"time"
+)
+
+// fileState is the modification state of a watched file
+type fileState struct {
+	mtime time.Time
+	size  int64
+}
+
+// watchedFiles returns the state of the plumbing file and its includes.
+// Missing files have a zero state.
+func (p *Plumber) watchedFiles() map[string]fileState {
+	list := make(map[string]fileState)
+	fname := p.Filename()
+	if len(fname) == 0 {
+		return list
+	}
+	for _, name := range append([]string{fname}, p.Includes()...) {
+		var st fileState
+		if fi, err := os.Stat(name); err == nil {
+			st = fileState{fi.ModTime(), fi.Size()}
+		}
+		list[name] = st
+	}
+	return list
+}
+
+// WatchRules starts polling the plumbing file and its includes for
+// changes and reloads the rules if a file changed. Polling ends when
+// 'stop' is closed.
+func (p *Plumber) WatchRules(interval time.Duration, stop <-chan struct{}) {
+	last := p.watchedFiles()
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+			}
+			curr := p.watchedFiles()
+			if maps.Equal(last, curr) {
+				continue
+			}
+			slog.Info("plumbing file changed on disk")
+			if err := p.Reload(); err != nil {
+				slog.Error("reload failed (keeping active rules)", "error", err)
+			}
+			// includes could have changed with the reload
+			last = p.watchedFiles()
+		}
+	}()
+}
@@ -0,0 +1,148 @@
+//----------------------------------------------------------------------
+// This file is part of plumber.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// plumber is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// plumber is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bfix/plumber/lib"
+	"github.com/knusbaum/go9p/proto"
+)
+
+const (
+	reloadRules = `
+type	is	text
+data	matches	'[a-zA-Z0-9_\-./]+\.go'
+plumb	to	edit
+`
+	reloadRulesTxt = `
+type	is	text
+data	matches	'[a-zA-Z0-9_\-./]+\.txt'
+plumb	to	edit
+`
+	reloadInclude = `
+type	is	text
+data	matches	'https?://[^ ]+'
+plumb	to	web
+`
+	reloadIncludePdf = `
+type	is	text
+data	matches	'[a-zA-Z0-9_\-./]+\.pdf'
+plumb	to	doc
+`
+)
+
+// write a file (with modification time in the future, so changes are
+// detected even on filesystems with coarse timestamps)
+func writeFile(t *testing.T, fname, content string, age int) {
+	t.Helper()
+	if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Duration(age) * time.Second)
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "plumbing")
+	inc := filepath.Join(dir, "include")
+	writeFile(t, inc, reloadInclude, 0)
+	writeFile(t, fname, "include "+inc+"\n"+reloadRules, 0)
+
+	p := NewPlumber()
+	p.Dry.Store(true)
+	p.Compat = true
+	if err := p.ParsePlumbingFile(fname, ""); err != nil {
+		t.Fatal(err)
+	}
+	p.NamespaceService()
+	if p.port("web") == nil {
+		t.Fatal("port from include missing")
+	}
+
+	// open port before the reload
+	acme := dial(t, p, "glenda")
+	sender := dial(t, p, "glenda")
+	port, err := acme.Open("edit", proto.Oread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	res := readAsync(port, 8192)
+
+	// reload changed rules
+	writeFile(t, fname, "include "+inc+"\n"+reloadRulesTxt, 1)
+	if err = p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	msg := lib.NewMessage("plumb", "", "/usr/glenda", "text", "notes.txt")
+	if err = plumb(sender, msg.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := await(t, res), string(msg.Pack()); got != exp {
+		t.Fatalf("got %q, expected %q", got, exp)
+	}
+
+	// invalid rules are rejected and the active rules are kept
+	active := string(p.File())
+	writeFile(t, fname, "type is text\nfoo bar baz\n", 2)
+	if err = p.Reload(); err == nil {
+		t.Fatal("invalid rules accepted")
+	}
+	if string(p.File()) != active {
+		t.Fatal("active rules changed")
+	}
+}
+
+func TestWatchRules(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "plumbing")
+	inc := filepath.Join(dir, "include")
+	writeFile(t, inc, reloadInclude, 0)
+	writeFile(t, fname, "include "+inc+"\n"+reloadRules, 0)
+
+	p := NewPlumber()
+	p.Dry.Store(true)
+	if err := p.ParsePlumbingFile(fname, ""); err != nil {
+		t.Fatal(err)
+	}
+	p.NamespaceService()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	p.WatchRules(10*time.Millisecond, stop)
+
+	// change of included file
+	writeFile(t, inc, reloadIncludePdf, 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for p.port("doc") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("change of include not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
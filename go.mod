@@ -3,12 +3,12 @@ module github.com/bfix/plumber
 go 1.25.3
 
 require (
+	9fans.net/go v0.0.7
 	github.com/bfix/gospel v1.2.31
 	github.com/knusbaum/go9p v1.18.0
 )
 
 require (
-	9fans.net/go v0.0.7 // indirect
 	github.com/Plan9-Archive/libauth v0.0.0-20180917063427-d1ca9e94969d // indirect
 	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6 // indirect
 	github.com/fhs/mux9p v0.3.1 // indirect
@@ -32,7 +32,9 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"log/slog"
 	"maps"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -61,6 +63,16 @@ func NewMessage(src, dst, wdir, typ, data string) *Message {
 	}
 }
 
+// LogValue returns the fields of a message that are logged (source,
+// destination and type).
+func (m *Message) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("src", m.Src),
+		slog.String("dst", m.Dst),
+		slog.String("type", m.Type),
+	)
+}
+
 // Clone a message
 func (m *Message) Clone() *Message {
 	o := &Message{
@@ -196,3 +208,125 @@ func (m *Message) Set(name, value string) (rc bool) {
 	}
 	return
 }
+
+//----------------------------------------------------------------------
+// Wire format as defined in plumb(6) and used by plan9port: the header
+// lines are followed by exactly 'ndata' bytes of (unencoded) data without
+// a terminating newline.
+//----------------------------------------------------------------------
+
+// Pack a message into its plumb(6) representation
+func (m *Message) Pack() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(m.Src + "\n")
+	buf.WriteString(m.Dst + "\n")
+	buf.WriteString(m.Wdir + "\n")
+	buf.WriteString(m.Type + "\n")
+	buf.WriteString(m.packAttr() + "\n")
+	buf.WriteString(fmt.Sprintf("%d\n", len(m.Data)))
+	buf.WriteString(m.Data)
+	return buf.Bytes()
+}
+
+// UnpackMessage parses a message in plumb(6) format from the start of
+// the buffer. It returns the message and the number of bytes consumed.
+// If the buffer does not (yet) contain a complete message, nil is
+// returned without error.
+func UnpackMessage(buf []byte) (m *Message, n int, err error) {
+	var hdr [6]string
+	pos := 0
+	for i := range hdr {
+		j := bytes.IndexByte(buf[pos:], '\n')
+		if j == -1 {
+			// incomplete header
+			return nil, 0, nil
+		}
+		hdr[i] = string(buf[pos : pos+j])
+		pos += j + 1
+	}
+	ndata, err := strconv.Atoi(hdr[5])
+	if err != nil || ndata < 0 {
+		return nil, 0, errors.New("malformed message")
+	}
+	if len(buf)-pos < ndata {
+		// incomplete data
+		return nil, 0, nil
+	}
+	m = &Message{
+		Src:   hdr[0],
+		Dst:   hdr[1],
+		Wdir:  hdr[2],
+		Type:  hdr[3],
+		Ndata: ndata,
+		Data:  string(buf[pos : pos+ndata]),
+	}
+	if m.Attr, err = unpackQuotedAttr(hdr[4]); err != nil {
+		return nil, 0, err
+	}
+	return m, pos + ndata, nil
+}
+
+// pack attributes with plumb(6) quoting of values
+func (m *Message) packAttr() string {
+	keys := slices.Sorted(maps.Keys(m.Attr))
+	list := make([]string, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, k+"="+quoteAttr(m.Attr[k]))
+	}
+	return strings.Join(list, " ")
+}
+
+// quote an attribute value if it contains special characters
+func quoteAttr(v string) string {
+	if len(v) == 0 {
+		return "''"
+	}
+	if !strings.ContainsAny(v, " \t\n'=") {
+		return v
+	}
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
+
+// unpack a list of attributes with (possibly) quoted values
+func unpackQuotedAttr(s string) (map[string]string, error) {
+	res := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t")
+		if len(s) == 0 {
+			break
+		}
+		i := strings.IndexByte(s, '=')
+		if i < 1 {
+			return nil, errors.New("malformed attribute")
+		}
+		name := s[:i]
+		s = s[i+1:]
+		var val strings.Builder
+		if len(s) > 0 && s[0] == '\'' {
+			// quoted value ('' is an escaped quote)
+			s = s[1:]
+			for {
+				j := strings.IndexByte(s, '\'')
+				if j == -1 {
+					return nil, errors.New("unterminated attribute")
+				}
+				val.WriteString(s[:j])
+				s = s[j+1:]
+				if len(s) == 0 || s[0] != '\'' {
+					break
+				}
+				val.WriteByte('\'')
+				s = s[1:]
+			}
+		} else {
+			j := strings.IndexAny(s, " \t")
+			if j == -1 {
+				j = len(s)
+			}
+			val.WriteString(s[:j])
+			s = s[j:]
+		}
+		res[name] = val.String()
+	}
+	return res, nil
+}
@@ -28,6 +28,7 @@
 package lib
 
 import (
+	"maps"
 	"slices"
 	"strings"
 	"testing"
@@ -88,3 +89,41 @@ func TestMessageMultilineData(t *testing.T) {
 		t.Fatal("mismatch")
 	}
 }
+
+func TestMessagePack(t *testing.T) {
+	m := NewMessage("acme", "edit", "/usr/glenda", "text", "line one\nline 'two'")
+	m.Attr["addr"] = "#12"
+	m.Attr["action"] = "show file"
+	m.Attr["quote"] = "it's"
+	buf := m.Pack()
+
+	exp := "acme\nedit\n/usr/glenda\ntext\naction='show file' addr=#12 quote='it''s'\n19\nline one\nline 'two'"
+	if string(buf) != exp {
+		t.Log(string(buf))
+		t.Log(exp)
+		t.Fatal("mismatch")
+	}
+	// unpack with trailing data
+	out, n, err := UnpackMessage(append(buf, "acme\n"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil || n != len(buf) {
+		t.Fatalf("unpack failed: n=%d", n)
+	}
+	if out.Data != m.Data || out.GetAttr() == "" || !maps.Equal(out.Attr, m.Attr) {
+		t.Log(out.String())
+		t.Fatal("mismatch")
+	}
+	// incomplete messages
+	for _, i := range []int{0, 5, len(buf) - 1} {
+		out, _, err = UnpackMessage(buf[:i])
+		if err != nil || out != nil {
+			t.Fatalf("incomplete message at %d not detected", i)
+		}
+	}
+	// malformed message
+	if _, _, err = UnpackMessage([]byte("a\nb\nc\nd\n\nxx\n")); err == nil {
+		t.Fatal("malformed message not detected")
+	}
+}
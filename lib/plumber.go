@@ -22,8 +22,13 @@ package lib
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 )
 
 // Action triggered by object "plumb"
@@ -34,35 +39,247 @@ type NewAction func() Action
 
 // Plumber
 type Plumber struct {
-	rl     *RuleList
-	worker NewAction
+	mtx     sync.RWMutex          // guard rule list swaps
+	swap    sync.Mutex            // serialize rule changes
+	rl      *RuleList             // active rules
+	worker  NewAction             // plumbing action
+	fname   string                // plumbing file loaded last
+	check   func(*RuleList) error // validate rules before activation
+	changed func()                // notify after rules changed
+	observe Observer              // notified after evaluations
+	log     *slog.Logger          // logger for parsing and evaluations
+}
+
+// discard is the logger used if no logger is set
+var discard = slog.New(slog.DiscardHandler)
+
+// logger returns the given logger or a logger that discards all records
+func logger(log *slog.Logger) *slog.Logger {
+	if log == nil {
+		return discard
+	}
+	return log
 }
 
 // NewPlumber creates a new plumber instance
 func NewPlumber(worker NewAction) *Plumber {
 	return &Plumber{
+		rl: &RuleList{
+			file:     []byte{},
+			Rulesets: []*RuleSet{},
+			Env:      make(map[string]string),
+			Exec:     worker,
+		},
 		worker: worker,
 	}
 }
 
-// ParsePlumbingFromRdr reads rulesets from a reader
-func (p *Plumber) ParsePlumbingFromRdr(rdr io.Reader) (err error) {
-	p.rl, err = ParsePlumbingFromRdr(rdr)
-	p.rl.Exec = p.worker
-	return
+// rules returns the active rule list
+func (p *Plumber) rules() *RuleList {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.rl
+}
+
+// SetHooks sets a function to validate new rules before they become
+// active and a function called after the active rules changed.
+func (p *Plumber) SetHooks(check func(*RuleList) error, changed func()) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.check = check
+	p.changed = changed
+}
+
+// SetObserver sets a function that is notified after every evaluation
+// of a message against the active rules (nil to remove it).
+func (p *Plumber) SetObserver(fn Observer) {
+	p.swap.Lock()
+	defer p.swap.Unlock()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.observe = fn
+	p.rl = p.rl.clone()
+	p.rl.Observe = fn
+}
+
+// SetLogger sets the logger for parsing rules and evaluating messages
+// (nil to discard log records). The library logs the steps of an
+// evaluation at debug level with the message and ruleset as fields.
+func (p *Plumber) SetLogger(log *slog.Logger) {
+	p.swap.Lock()
+	defer p.swap.Unlock()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.log = log
+	p.rl = p.rl.clone()
+	p.rl.Log = log
+}
+
+// ParsePlumbingFromRdr reads rulesets from a reader. The active rules
+// are only replaced if the new rules are valid.
+func (p *Plumber) ParsePlumbingFromRdr(rdr io.Reader) error {
+	p.mtx.RLock()
+	log := p.log
+	p.mtx.RUnlock()
+	rl, err := parsePlumbing(rdr, logger(log))
+	if err != nil {
+		return err
+	}
+	p.swap.Lock()
+	defer p.swap.Unlock()
+	p.mtx.RLock()
+	rl.Exec, rl.Observe, rl.Log = p.worker, p.observe, p.log
+	p.mtx.RUnlock()
+	return p.activate(rl)
+}
+
+// activate new rules if they are valid (called with 'swap' locked)
+func (p *Plumber) activate(rl *RuleList) error {
+	p.mtx.RLock()
+	check, changed := p.check, p.changed
+	p.mtx.RUnlock()
+	if err := rl.checkNames(); err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(rl); err != nil {
+			return err
+		}
+	}
+	p.mtx.Lock()
+	p.rl = rl
+	p.mtx.Unlock()
+	if changed != nil {
+		changed()
+	}
+	return nil
+}
+
+// Modify the active rules: the function changes a copy of the active
+// rule list that replaces the active rules if it is valid. Changes are
+// serialized with other rule changes.
+func (p *Plumber) Modify(fn func(rl *RuleList) error) error {
+	p.swap.Lock()
+	defer p.swap.Unlock()
+	rl := p.rules().clone()
+	if err := fn(rl); err != nil {
+		return err
+	}
+	return p.activate(rl)
+}
+
+// editRulesets modifies the rulesets of the active rules. Unlike other
+// modifications, the text of the rules (see File) no longer matches the
+// rule list and is generated from it: comments are lost and included
+// rules become part of the text.
+func (p *Plumber) editRulesets(fn func(rl *RuleList) error) error {
+	return p.Modify(func(rl *RuleList) error {
+		if err := fn(rl); err != nil {
+			return err
+		}
+		rl.file = rl.Format()
+		return nil
+	})
+}
+
+// EnableRuleset enables or disables a ruleset (referenced by name or
+// index) in the active rules. Disabled rulesets are skipped during
+// evaluation.
+func (p *Plumber) EnableRuleset(ref string, enable bool) error {
+	return p.Modify(func(rl *RuleList) error {
+		idx, err := rl.Lookup(ref)
+		if err != nil {
+			return err
+		}
+		rs := *rl.Rulesets[idx]
+		rs.Disabled = !enable
+		rl.Rulesets[idx] = &rs
+		return nil
+	})
+}
+
+// InsertRuleset inserts a ruleset at given index in the active rules
+// (at the end if the index equals the number of rulesets).
+func (p *Plumber) InsertRuleset(idx int, rs *RuleSet) error {
+	return p.editRulesets(func(rl *RuleList) error {
+		if idx < 0 || idx > len(rl.Rulesets) {
+			return fmt.Errorf("invalid ruleset index %d", idx)
+		}
+		rl.Rulesets = slices.Insert(rl.Rulesets, idx, rs)
+		return nil
+	})
+}
+
+// ReplaceRuleset replaces an active ruleset; the ruleset is removed if
+// the replacement is nil. Fails if the ruleset is not active (anymore).
+func (p *Plumber) ReplaceRuleset(old, rs *RuleSet) error {
+	return p.editRulesets(func(rl *RuleList) error {
+		idx := slices.Index(rl.Rulesets, old)
+		if idx < 0 {
+			return errors.New("ruleset not active")
+		}
+		if rs == nil {
+			rl.Rulesets = slices.Delete(rl.Rulesets, idx, idx+1)
+		} else {
+			rl.Rulesets[idx] = rs
+		}
+		return nil
+	})
+}
+
+// SetEnv sets a variable in the environment of the active rules; an
+// empty value removes the variable.
+func (p *Plumber) SetEnv(key, val string) error {
+	return p.UpdateEnv(map[string]string{key: val})
+}
+
+// UpdateEnv sets variables in the environment of the active rules (in
+// a single change); variables with empty values are removed. The text of
+// the rules (see File) is not changed.
+func (p *Plumber) UpdateEnv(vars map[string]string) error {
+	return p.Modify(func(rl *RuleList) error {
+		for key, val := range vars {
+			if len(key) == 0 || strings.ContainsAny(key, " \t=") {
+				return fmt.Errorf("invalid variable name '%s'", key)
+			}
+			if len(val) == 0 {
+				delete(rl.Env, key)
+			} else {
+				rl.Env[key] = val
+			}
+		}
+		return nil
+	})
 }
 
 // ParsePlumbingFile with a fallback if the initial read fails
 func (p *Plumber) ParsePlumbingFile(fname, fallback string) error {
 	err := p.parsePlumbingFile(fname)
-	if err != nil {
+	if err != nil && len(fallback) > 0 {
 		err = p.parsePlumbingFile(fallback)
 	}
 	return err
 }
 
+// Reload the plumbing file loaded last. The active rules are kept if
+// the file can't be read or is invalid.
+func (p *Plumber) Reload() error {
+	return p.parsePlumbingFile(p.Filename())
+}
+
+// Filename returns the name of the plumbing file loaded last
+func (p *Plumber) Filename() string {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.fname
+}
+
+// Includes returns the files included by the active rules
+func (p *Plumber) Includes() []string {
+	return p.rules().Includes()
+}
+
 // ParsePlumbingFile reads rules from a file.
-// If the file does not exist, the
 func (p *Plumber) parsePlumbingFile(fname string) error {
 	if len(fname) == 0 {
 		return errors.New("no filename")
@@ -72,22 +289,39 @@ func (p *Plumber) parsePlumbingFile(fname string) error {
 		return err
 	}
 	defer f.Close()
-	return p.ParsePlumbingFromRdr(f)
+	if err = p.ParsePlumbingFromRdr(f); err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	p.fname = fname
+	p.mtx.Unlock()
+	return nil
 }
 
 // Ports returns a list of all ports referenced in the current list of rules
 func (p *Plumber) Ports() (list []string) {
-	return p.rl.Ports()
+	return p.rules().Ports()
+}
+
+// DynamicPorts returns a list of port names in the current list of
+// rules that depend on message data
+func (p *Plumber) DynamicPorts() []string {
+	return p.rules().DynamicPorts()
 }
 
 // File returns the current rules as a byte array
 func (p *Plumber) File() []byte {
-	return p.rl.File()
+	return p.rules().File()
 }
 
 // Env returns the current environment from the rules file
 func (p *Plumber) Env() map[string]string {
-	return p.rl.Env
+	return p.rules().Env
+}
+
+// Rulesets returns the active rulesets
+func (p *Plumber) Rulesets() []*RuleSet {
+	return p.rules().Rulesets
 }
 
 // Eval runs evaluation of data based on defined rules
@@ -100,12 +334,30 @@ func (p *Plumber) Eval(data, src, dst, wdir string) (bool, error) {
 		Ndata: len(data),
 		Data:  data,
 	}
-	out, _, err := p.rl.Evaluate(msg, false)
+	out, _, err := p.rules().Evaluate(msg, false)
 	return out != nil, err
 }
 
 // Process a plumbing message
 func (p *Plumber) Process(msg *Message) (bool, error) {
-	out, _, err := p.rl.Evaluate(msg, false)
+	out, _, err := p.rules().Evaluate(msg, false)
 	return out != nil, err
 }
+
+// Trace processes a plumbing message with the given worker for 'plumb'
+// actions. Returns the resulting message and the reference to the
+// matching ruleset (or nil and a reference to no ruleset).
+func (p *Plumber) Trace(msg *Message, worker NewAction) (*Message, Ref, error) {
+	rl := p.rules()
+	out, rid, err := rl.EvaluateWith(msg, false, worker)
+	return out, rl.Ref(rid), err
+}
+
+// Simulate processes a plumbing message like Trace, but the evaluation
+// is not reported to the observer (see SetObserver).
+func (p *Plumber) Simulate(msg *Message, worker NewAction) (*Message, Ref, error) {
+	rl := *p.rules()
+	rl.Observe = nil
+	out, rid, err := rl.EvaluateWith(msg, false, worker)
+	return out, rl.Ref(rid), err
+}
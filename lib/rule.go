@@ -29,14 +29,13 @@ package lib
 
 import (
 	"fmt"
+	"log/slog"
 	"maps"
 	"os"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
-
-	"github.com/bfix/gospel/logger"
 )
 
 // Grammer contains a list of (valid) verbs for an object
@@ -95,6 +94,7 @@ type Kernel struct {
 	vars   map[string]string // variables
 	state  map[string]string // processing state
 	worker Action            // performs plumbing action
+	log    *slog.Logger      // logger for evaluation steps
 }
 
 // NewKernel creates a new kernel instance
@@ -108,6 +108,7 @@ func NewKernel(w Action) *Kernel {
 		vars:   make(map[string]string),
 		state:  make(map[string]string),
 		worker: w,
+		log:    discard,
 	}
 }
 
@@ -120,6 +121,7 @@ func (k *Kernel) Clone() *Kernel {
 	r.state = maps.Clone(k.state)
 	r.withFS = k.withFS
 	r.worker = k.worker
+	r.log = k.log
 	return r
 }
 
@@ -177,7 +179,7 @@ func (k *Kernel) Execute(r *Rule, env map[string]string) (ok bool, done bool, er
 			break
 		}
 		matches := k.re.FindAllStringSubmatch(obj, -1)
-		logger.Printf(logger.DBG, "~ match '%s' against '%s' => %v", obj, data, matches)
+		k.log.Debug("match", "object", obj, "pattern", data, "matches", matches)
 		if ok = (matches != nil && (obj == matches[0][0])); ok {
 			k.dollar = matches[0]
 		}
@@ -220,7 +222,7 @@ func (k *Kernel) Execute(r *Rule, env map[string]string) (ok bool, done bool, er
 			k.vars["file"] = data
 		}
 	case "set":
-		logger.Printf(logger.DBG, "SET: %s = %s", r.Obj, data)
+		k.log.Debug("set", "object", r.Obj, "value", data)
 		ok = k.Set(r.Obj, data)
 	case "add":
 		maps.Copy(k.Attr, k.unpackAttr(data))
@@ -242,16 +244,21 @@ func (k *Kernel) Execute(r *Rule, env map[string]string) (ok bool, done bool, er
 	return
 }
 
-// expand $-variables in unquoted string
+// expand $-variables in unquoted string: variables of the rules take
+// precedence over message values; the OS environment is the last resort.
 func (k *Kernel) expand(s string, env map[string]string) string {
 	lookup := func(name string) string {
 		if v, ok := env[name]; ok {
 			return v
 		}
-		v, _ := k.Get(name)
+		v, err := k.Get(name)
+		if err != nil {
+			// OS environment as fallback
+			v = os.Getenv(name)
+		}
 		return v
 	}
 	out := Unquote(s, lookup)
-	logger.Printf(logger.DBG, "EXPAND: '%s' -> '%s'", s, out)
+	k.log.Debug("expand", "text", s, "result", out)
 	return out
 }
@@ -29,7 +29,9 @@ package lib
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func getRuleList(fname string) (rs *RuleList, err error) {
@@ -73,9 +75,15 @@ func TestRulesEval(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	rs.Exec = func() Action {
+		return func(msg *Message, verb, data string) (ok, done bool) {
+			return true, true
+		}
+	}
 
 	for i, d := range data {
 		msg := &Message{
+			Data: d[0],
 			Src:  d[1],
 			Dst:  d[2],
 			Wdir: "",
@@ -91,3 +99,236 @@ func TestRulesEval(t *testing.T) {
 		}
 	}
 }
+
+func TestRulesInvalid(t *testing.T) {
+	p := NewPlumber(nil)
+	valid := "type is text\nplumb to edit\n"
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(valid)); err != nil {
+		t.Fatal(err)
+	}
+	for _, rules := range []string{
+		"type is text\nfoo bar baz\n",
+		"type is text\n{\nplumb to edit\n",
+		"type is text\n}\n",
+		"type\n",
+	} {
+		if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err == nil {
+			t.Fatalf("invalid rules accepted: %q", rules)
+		}
+		if string(p.File()) != valid {
+			t.Fatal("active rules replaced by invalid rules")
+		}
+	}
+}
+
+func TestRulesPorts(t *testing.T) {
+	rules := "editor = acme\n\n" +
+		"type is text\nplumb to $editor\n\n" +
+		"type is text\nplumb to 'web'\n\n" +
+		"type is text\ndata matches 'port:(.*)'\nplumb to $1\n"
+	rl, err := ParsePlumbingFromRdr(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports := rl.Ports(); strings.Join(ports, ",") != "acme,web" {
+		t.Fatalf("unexpected ports %v", ports)
+	}
+	if ports := rl.DynamicPorts(); strings.Join(ports, ",") != "$1" {
+		t.Fatalf("unexpected dynamic ports %v", ports)
+	}
+}
+
+func TestRulesModify(t *testing.T) {
+	rules := "editor = acme\n\n" +
+		"type is text\ndata matches '.*\\.go'\nplumb to $editor\n\n" +
+		"type is text\nplumb to web\n"
+	var ports []string
+	worker := func() Action {
+		return func(msg *Message, verb, data string) (bool, bool) { return true, true }
+	}
+	p := NewPlumber(worker)
+	p.SetHooks(nil, func() { ports = p.Ports() })
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	old := p.rules()
+
+	// disabled rulesets are skipped
+	if err := p.EnableRuleset("0", false); err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{Type: "text", Data: "main.go", Attr: map[string]string{}}
+	if _, ref, _ := p.Trace(msg, worker); ref.Index != 1 {
+		t.Fatalf("ruleset %s matched", ref)
+	}
+	if err := p.EnableRuleset("0", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ref, _ := p.Trace(msg, worker); ref.Index != 0 {
+		t.Fatalf("ruleset %s matched", ref)
+	}
+	if p.EnableRuleset("2", false) == nil {
+		t.Fatal("unknown ruleset disabled")
+	}
+	// variables change resolved port names
+	if err := p.SetEnv("editor", "sam"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ports, ",") != "sam,web" {
+		t.Fatalf("unexpected ports %v", ports)
+	}
+	// changes don't affect the replaced rules
+	if old.Rulesets[0].Disabled || old.Env["editor"] != "acme" {
+		t.Fatal("replaced rules modified")
+	}
+}
+
+func TestRulesObserver(t *testing.T) {
+	worker := func() Action {
+		return func(msg *Message, verb, data string) (bool, bool) { return true, true }
+	}
+	var refs []string
+	p := NewPlumber(worker)
+	p.SetObserver(func(in *Message, ref Ref, elapsed time.Duration, err error) {
+		refs = append(refs, in.Data+"="+ref.String())
+	})
+	rules := "ruleset name: go\ntype is text\ndata matches '.*\\.go'\nplumb to edit\n"
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	// evaluations are observed (also after rule changes)
+	p.Eval("main.go", "", "", "/")
+	p.Eval("nothing", "", "", "/")
+	p.Trace(&Message{Type: "text", Data: "x.go", Attr: map[string]string{}}, worker)
+	// simulations are not observed
+	p.Simulate(&Message{Type: "text", Data: "y.go", Attr: map[string]string{}}, worker)
+	if got := strings.Join(refs, ","); got != "main.go=go,nothing=none,x.go=go" {
+		t.Fatalf("observed %s", got)
+	}
+}
+
+func TestRulesNamed(t *testing.T) {
+	rules := "ruleset name: go-files\n" +
+		"ruleset description: Go sources to the editor\n" +
+		"ruleset tags: code, edit\n" +
+		"type is text\ndata matches '.*\\.go'\nplumb to edit\n\n" +
+		"type is text\nplumb to web\n"
+	worker := func() Action {
+		return func(msg *Message, verb, data string) (bool, bool) { return true, true }
+	}
+	p := NewPlumber(worker)
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	rs := p.Rulesets()[0]
+	if rs.Name != "go-files" || rs.Description != "Go sources to the editor" || strings.Join(rs.Tags, ",") != "code,edit" {
+		t.Fatalf("header: %q %q %v", rs.Name, rs.Description, rs.Tags)
+	}
+	// the header is part of the text of the ruleset
+	if out, err := ParseRuleSet(rs.String()); err != nil || out.String() != rs.String() {
+		t.Fatalf("header not formatted: %q", rs.String())
+	}
+	// matches are referenced by name (or index for unnamed rulesets)
+	msg := &Message{Type: "text", Data: "main.go", Attr: map[string]string{}}
+	if _, ref, _ := p.Trace(msg, worker); ref.String() != "go-files" || ref.Index != 0 {
+		t.Fatalf("ruleset %s matched", ref)
+	}
+	if err := p.EnableRuleset("go-files", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ref, _ := p.Trace(msg, worker); ref.String() != "1" {
+		t.Fatalf("ruleset %s matched", ref)
+	}
+	if p.EnableRuleset("c-files", true) == nil {
+		t.Fatal("unknown ruleset enabled")
+	}
+	for _, bad := range []string{
+		"ruleset name: 42\ntype is text\nplumb to edit\n",
+		"ruleset name: a b\ntype is text\nplumb to edit\n",
+		"ruleset owner: glenda\ntype is text\nplumb to edit\n",
+		"type is text\nruleset name: late\nplumb to edit\n",
+		"ruleset name: a\ntype is text\nplumb to edit\n\nruleset name: a\ntype is text\nplumb to web\n",
+	} {
+		if _, err := ParsePlumbingFromRdr(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	// names stay unique when rulesets are inserted
+	dup, err := ParseRuleSet("ruleset name: go-files\ntype is text\nplumb to web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.InsertRuleset(0, dup) == nil {
+		t.Fatal("duplicate name inserted")
+	}
+}
+
+func TestRulesEditRulesets(t *testing.T) {
+	rules := "# editor\neditor = acme\n\n" +
+		"type is text\ndata matches '.*\\.go'\nplumb to $editor\n"
+	p := NewPlumber(nil)
+	if err := p.ParsePlumbingFromRdr(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	// other modifications keep the text of the rules
+	if err := p.EnableRuleset("0", false); err != nil {
+		t.Fatal(err)
+	}
+	if string(p.File()) != rules {
+		t.Fatal("rules text changed")
+	}
+	// ruleset edits generate the text from the rules
+	rs, err := ParseRuleSetFromRdr(strings.NewReader("type is text\nplumb to web\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.InsertRuleset(1, rs); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.ReplaceRuleset(p.Rulesets()[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	exp := "editor = acme\n\ntype is text\nplumb to web\n"
+	if string(p.File()) != exp {
+		t.Fatalf("got %q, expected %q", p.File(), exp)
+	}
+	rl, err := ParsePlumbingFromRdr(strings.NewReader(exp))
+	if err != nil || len(rl.Rulesets) != 1 || rl.Env["editor"] != "acme" {
+		t.Fatal("generated rules can't be parsed")
+	}
+	if _, err = ParseRuleSetFromRdr(strings.NewReader(exp)); err == nil {
+		t.Fatal("variables accepted in ruleset")
+	}
+}
+
+func TestRulesOSEnv(t *testing.T) {
+	t.Setenv("PLUMB_VIEWER", "page")
+	t.Setenv("PLUMB_EDITOR", "vi")
+	rules := "PLUMB_EDITOR = acme\n\n" +
+		"type is text\ndata matches '.*\\.go'\nplumb to $PLUMB_EDITOR\n\n" +
+		"type is text\nplumb to $PLUMB_VIEWER\nplumb start $PLUMB_VIEWER $data\n"
+	rl, err := ParsePlumbingFromRdr(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// variables of the rules take precedence over the OS environment
+	if ports := rl.Ports(); strings.Join(ports, ",") != "acme,page" {
+		t.Fatalf("unexpected ports %v", ports)
+	}
+	var started string
+	worker := func() Action {
+		return func(msg *Message, verb, data string) (bool, bool) {
+			if verb == "start" {
+				started = data
+			}
+			return true, verb == "start"
+		}
+	}
+	msg := &Message{Type: "text", Data: "image.png", Attr: map[string]string{}}
+	if _, _, err = rl.EvaluateWith(msg, false, worker); err != nil {
+		t.Fatal(err)
+	}
+	if started != "page image.png" {
+		t.Fatalf("started '%s'", started)
+	}
+}
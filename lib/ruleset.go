@@ -29,29 +29,69 @@ package lib
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bfix/gospel/data"
-	"github.com/bfix/gospel/logger"
 )
 
 // RuleList is a list of rules and environment variables
 type RuleList struct {
 	file     []byte            // plumbing file
+	includes []string          // included files
 	Rulesets []*RuleSet        // list of rules
 	Env      map[string]string // environment variables
 	Exec     NewAction         // plumbing action
+	Observe  Observer          // notified after evaluations (or nil)
+	Log      *slog.Logger      // logger for evaluations (or nil)
 }
 
+// Observer is notified after a message was evaluated with the reference
+// to the matching ruleset, the duration of the evaluation and the error
+// (if any).
+type Observer func(in *Message, ref Ref, elapsed time.Duration, err error)
+
 // Evaluate incoming message against all rulesets.
 // If msg is not null, rid points to the matching ruleset
 func (rl *RuleList) Evaluate(in *Message, withFS bool) (out *Message, rid int, err error) {
+	return rl.EvaluateWith(in, withFS, rl.Exec)
+}
+
+// EvaluateWith evaluates a message like Evaluate, but with the given
+// worker for 'plumb' actions.
+func (rl *RuleList) EvaluateWith(in *Message, withFS bool, worker NewAction) (out *Message, rid int, err error) {
 	rid = -1
+	if rl.Observe != nil {
+		start := time.Now()
+		defer func() {
+			rl.Observe(in, rl.Ref(rid), time.Since(start), err)
+		}()
+	}
+	log := logger(rl.Log)
+	debug := log.Enabled(context.Background(), slog.LevelDebug)
+	if debug {
+		log = log.With("message", in)
+	}
 	for i, r := range rl.Rulesets {
-		if out, err = r.Evaluate(in, rl.Env, withFS, rl.Exec); err != nil {
+		if r.Disabled {
+			continue
+		}
+		rlog := log
+		if debug {
+			rlog = log.With("ruleset", rl.Ref(i).String())
+		}
+		if out, err = r.evaluate(in, rl.Env, withFS, worker, rlog); err != nil {
 			return
 		}
 		if out == nil {
@@ -63,21 +103,136 @@ func (rl *RuleList) Evaluate(in *Message, withFS bool) (out *Message, rid int, e
 	return
 }
 
+// Lookup returns the index of a ruleset referenced by name or index
+func (rl *RuleList) Lookup(ref string) (int, error) {
+	for i, r := range rl.Rulesets {
+		if len(r.Name) > 0 && r.Name == ref {
+			return i, nil
+		}
+	}
+	if idx, err := strconv.Atoi(ref); err == nil && idx >= 0 && idx < len(rl.Rulesets) {
+		return idx, nil
+	}
+	return -1, fmt.Errorf("no ruleset '%s'", ref)
+}
+
+// Ref returns the reference to the ruleset with given index (or to no
+// ruleset for a negative index).
+func (rl *RuleList) Ref(idx int) Ref {
+	if idx < 0 || idx >= len(rl.Rulesets) {
+		return Ref{Index: -1}
+	}
+	return Ref{Index: idx, Name: rl.Rulesets[idx].Name}
+}
+
+// checkNames returns an error if ruleset names are not unique
+func (rl *RuleList) checkNames() error {
+	names := make(map[string]bool)
+	for _, r := range rl.Rulesets {
+		if len(r.Name) == 0 {
+			continue
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate ruleset name '%s'", r.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
+
+// clone returns a copy of the rule list that can be changed without
+// affecting the original list (rulesets are shared).
+func (rl *RuleList) clone() *RuleList {
+	out := *rl
+	out.Rulesets = slices.Clone(rl.Rulesets)
+	out.Env = maps.Clone(rl.Env)
+	return &out
+}
+
 // File returns the active rules as a byte array
 func (rl *RuleList) File() []byte {
 	return rl.file
 }
 
-// Ports returns all ports referenced in in list
+// Format returns the rules as text: variables (sorted by name) followed
+// by the rulesets.
+func (rl *RuleList) Format() []byte {
+	buf := new(bytes.Buffer)
+	for _, key := range slices.Sorted(maps.Keys(rl.Env)) {
+		fmt.Fprintf(buf, "%s = %s\n", key, rl.Env[key])
+	}
+	for _, r := range rl.Rulesets {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(r.String() + "\n")
+	}
+	return buf.Bytes()
+}
+
+// Includes returns the names of all included files
+func (rl *RuleList) Includes() []string {
+	return rl.includes
+}
+
+// Ports returns all ports referenced in in list. Variables in port names
+// are resolved against the environment; port names depending on message
+// data (see DynamicPorts) are not included.
 func (rl *RuleList) Ports() (list []string) {
 	for _, r := range rl.Rulesets {
-		list = append(list, r.Ports()...)
+		for _, name := range r.Ports() {
+			if port, ok := rl.resolve(name); ok {
+				list = append(list, port)
+			}
+		}
 	}
 	return
 }
 
-// ParsePlumbingFromRdr reads a list of rules and environment settings from a reader
+// DynamicPorts returns all referenced port names that can only be
+// resolved when a message is evaluated (unexpanded).
+func (rl *RuleList) DynamicPorts() (list []string) {
+	for _, r := range rl.Rulesets {
+		for _, name := range r.Ports() {
+			if _, ok := rl.resolve(name); !ok {
+				list = append(list, name)
+			}
+		}
+	}
+	return
+}
+
+// resolve variables in a port name against the environment (with the
+// OS environment as fallback). Returns false if a variable is not
+// defined in either environment.
+func (rl *RuleList) resolve(name string) (string, bool) {
+	static := true
+	port := Unquote(name, func(key string) string {
+		v, ok := rl.Env[key]
+		if !ok {
+			v, ok = os.LookupEnv(key)
+		}
+		if !ok {
+			static = false
+		}
+		return v
+	})
+	return port, static
+}
+
+// IncludeDir is the directory for included plumbing files with
+// relative names.
+var IncludeDir = "/usr/lib/plumb"
+
+// ParsePlumbingFromRdr reads a list of rules and environment settings
+// from a reader. No rule list is returned if the input is invalid.
 func ParsePlumbingFromRdr(in io.Reader) (rs *RuleList, err error) {
+	return parsePlumbing(in, discard)
+}
+
+// parsePlumbing reads a list of rules (see ParsePlumbingFromRdr) and logs
+// variables and failed includes.
+func parsePlumbing(in io.Reader, log *slog.Logger) (rs *RuleList, err error) {
 	rs = &RuleList{
 		file:     []byte{},
 		Rulesets: []*RuleSet{},
@@ -85,12 +240,13 @@ func ParsePlumbingFromRdr(in io.Reader) (rs *RuleList, err error) {
 	}
 
 	// parse rules
-	parseRuleSet := func(r string) {
-		var ruleset *RuleSet
-		if ruleset, err = ParseRuleSet(r); err != nil {
-			return
+	parseRuleSet := func(r string) error {
+		ruleset, err := ParseRuleSet(r)
+		if err != nil {
+			return err
 		}
 		rs.Rulesets = append(rs.Rulesets, ruleset)
+		return nil
 	}
 
 	// read rules as a list of multi-line strings
@@ -108,7 +264,7 @@ func ParsePlumbingFromRdr(in io.Reader) (rs *RuleList, err error) {
 				}
 				break
 			}
-			return
+			return nil, err
 		}
 		if rdrSt.Len() == 0 {
 			rs.file = append(rs.file, s...)
@@ -127,25 +283,33 @@ func ParsePlumbingFromRdr(in io.Reader) (rs *RuleList, err error) {
 		parts := strings.SplitN(t, " ", 3)
 		if len(parts) == 3 && parts[1] == "=" && len(parts[2]) > 0 {
 			rs.Env[parts[0]] = parts[2]
-			logger.Printf(logger.DBG, "ENV: %s=%s", parts[0], parts[2])
+			log.Debug("variable", "name", parts[0], "value", parts[2])
 			continue
 		}
 		// check for include command
-		if parts[0] == "include" {
-			f, err := os.Open("/usr/lib/plumb/" + parts[1])
+		if parts[0] == "include" && len(parts) > 1 {
+			fname := parts[1]
+			if !filepath.IsAbs(fname) {
+				fname = filepath.Join(IncludeDir, fname)
+			}
+			rs.includes = append(rs.includes, fname)
+			f, err := os.Open(fname)
 			if err != nil {
-				logger.Printf(logger.WARN, "import of '%s' failed", parts[1])
+				log.Warn("include failed", "file", parts[1], "error", err)
 			} else {
 				defer f.Close()
 				rdrSt.Push(rdr)
 				rdr = bufio.NewReader(f)
 			}
+			continue
 		}
 
 		// handle possible rule
 		if len(line) == 0 {
 			if len(buf) > 0 {
-				parseRuleSet(buf)
+				if err = parseRuleSet(buf); err != nil {
+					return nil, err
+				}
 			}
 			buf = ""
 			continue
@@ -156,21 +320,73 @@ func ParsePlumbingFromRdr(in io.Reader) (rs *RuleList, err error) {
 		buf += Canonical(line)
 	}
 	if len(buf) > 0 {
-		parseRuleSet(buf)
+		if err = parseRuleSet(buf); err != nil {
+			return nil, err
+		}
 	}
-	return
+	if err = rs.checkNames(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// ParseRuleSetFromRdr reads a single ruleset from a reader. Variables
+// and includes are not allowed.
+func ParseRuleSetFromRdr(in io.Reader) (*RuleSet, error) {
+	rl, err := ParsePlumbingFromRdr(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(rl.Env) > 0 || len(rl.includes) > 0 {
+		return nil, errors.New("variables and includes not allowed in ruleset")
+	}
+	if len(rl.Rulesets) != 1 {
+		return nil, fmt.Errorf("expected one ruleset, got %d", len(rl.Rulesets))
+	}
+	return rl.Rulesets[0], nil
+}
+
+//----------------------------------------------------------------------
+
+// Ref references a ruleset of a rule list by index and name (if the
+// ruleset is named). The index of an unmatched message is -1.
+type Ref struct {
+	Index int    // index of the ruleset (or -1)
+	Name  string // name of the ruleset (optional)
+}
+
+// String returns the name of the referenced ruleset, its index if the
+// ruleset is not named or 'none'.
+func (r Ref) String() string {
+	switch {
+	case r.Index < 0:
+		return "none"
+	case len(r.Name) > 0:
+		return r.Name
+	}
+	return strconv.Itoa(r.Index)
 }
 
 //----------------------------------------------------------------------
 
-// RuleSet is a list of rules that are evaluated against an input
+// RuleSet is a list of rules that are evaluated against an input. A
+// ruleset can have an optional header that names and describes it:
+//
+//	ruleset name: open-urls
+//	ruleset description: open web links in the browser
+//	ruleset tags: web, browser
 type RuleSet struct {
-	Rules []any // can be *Rule or *RuleSet
+	Name        string   // name of the ruleset (optional, unique)
+	Description string   // description of the ruleset
+	Tags        []string // tags of the ruleset
+	Rules       []any    // can be *Rule or *RuleSet
+	Disabled    bool     // ruleset is skipped during evaluation
 }
 
 // ParseRuleSet parses a single ruleset from a multi-line string
 // Rulesets can be nested.
 func ParseRuleSet(s string) (r *RuleSet, err error) {
+	r = new(RuleSet)
 	var curr []any
 	st := data.NewStack()
 	for line := range strings.SplitSeq(s, "\n") {
@@ -178,12 +394,25 @@ func ParseRuleSet(s string) (r *RuleSet, err error) {
 		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
+		// handle header (before the first rule)
+		if hdr, ok := strings.CutPrefix(line, "ruleset "); ok {
+			if st.Len() > 0 || len(curr) > 0 {
+				return nil, fmt.Errorf("ruleset header after rules: '%s'", line)
+			}
+			if err = r.header(hdr); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		// handle nesting
 		if line[0] == '{' {
 			st.Push(curr)
 			curr = []any{}
 			continue
 		} else if line[0] == '}' {
+			if st.Len() == 0 {
+				return nil, errors.New("unbalanced '}' in ruleset")
+			}
 			last := st.Pop().([]any)
 			last = append(last, curr)
 			curr = last
@@ -192,9 +421,8 @@ func ParseRuleSet(s string) (r *RuleSet, err error) {
 		// parse rule
 		line = Canonical(line)
 		words := strings.SplitN(line, " ", 3)
-		if !grammer.Valid(words[0], words[1]) {
-			err = fmt.Errorf("invalid rule: '%s'", line)
-			break
+		if len(words) < 3 || !grammer.Valid(words[0], words[1]) {
+			return nil, fmt.Errorf("invalid rule: '%s'", line)
 		}
 		rule := &Rule{
 			Obj:  words[0],
@@ -203,14 +431,63 @@ func ParseRuleSet(s string) (r *RuleSet, err error) {
 		}
 		curr = append(curr, rule)
 	}
-	return &RuleSet{
-		Rules: curr,
-	}, nil
+	if st.Len() > 0 {
+		return nil, errors.New("unbalanced '{' in ruleset")
+	}
+	r.Rules = curr
+	return r, nil
+}
+
+// header parses a ruleset header line ('<key>: <value>')
+func (r *RuleSet) header(hdr string) error {
+	key, val, ok := strings.Cut(hdr, ":")
+	if !ok {
+		return fmt.Errorf("invalid ruleset header '%s'", hdr)
+	}
+	val = strings.TrimSpace(val)
+	switch strings.TrimSpace(key) {
+	case "name":
+		if err := CheckRulesetName(val); err != nil {
+			return err
+		}
+		r.Name = val
+	case "description":
+		r.Description = val
+	case "tags":
+		r.Tags = strings.FieldsFunc(val, func(c rune) bool {
+			return c == ',' || c == ' '
+		})
+	default:
+		return fmt.Errorf("unknown ruleset header '%s'", key)
+	}
+	return nil
+}
+
+// CheckRulesetName returns an error if a name can't be used for a
+// ruleset: names are single words that can't be mistaken for an index.
+func CheckRulesetName(name string) error {
+	if len(name) == 0 || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid ruleset name '%s'", name)
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return fmt.Errorf("numeric ruleset name '%s'", name)
+	}
+	return nil
 }
 
 // String returns a human-readble representation of a rule
 func (r *RuleSet) String() string {
-	return strings.Join(r.lines(""), "\n")
+	var hdr []string
+	if len(r.Name) > 0 {
+		hdr = append(hdr, "ruleset name: "+r.Name)
+	}
+	if len(r.Description) > 0 {
+		hdr = append(hdr, "ruleset description: "+r.Description)
+	}
+	if len(r.Tags) > 0 {
+		hdr = append(hdr, "ruleset tags: "+strings.Join(r.Tags, ", "))
+	}
+	return strings.Join(append(hdr, r.lines("")...), "\n")
 }
 
 // return the ruleset as a list of rule lines (correctly indented)
@@ -221,7 +498,7 @@ func (r *RuleSet) lines(indent string) (list []string) {
 			list = append(list, x.String())
 		case []any:
 			list = append(list, indent+"{")
-			s := (&RuleSet{x}).lines(indent + "  ")
+			s := (&RuleSet{Rules: x}).lines(indent + "  ")
 			list = append(list, s...)
 			list = append(list, indent+"}")
 		}
@@ -238,7 +515,7 @@ func (r *RuleSet) Ports() (list []string) {
 				list = append(list, x.Data)
 			}
 		case []any:
-			p := (&RuleSet{x}).Ports()
+			p := (&RuleSet{Rules: x}).Ports()
 			list = append(list, p...)
 		}
 	}
@@ -248,7 +525,17 @@ func (r *RuleSet) Ports() (list []string) {
 // Evaluate a rule against input
 func (r *RuleSet) Evaluate(in *Message, env map[string]string, withFS bool, worker NewAction) (out *Message, err error,
 ) {
-	k := NewKernel(worker())
+	return r.evaluate(in, env, withFS, worker, discard)
+}
+
+// evaluate a rule against input (see Evaluate) and log the steps
+func (r *RuleSet) evaluate(in *Message, env map[string]string, withFS bool, worker NewAction, log *slog.Logger) (out *Message, err error) {
+	var w Action
+	if worker != nil {
+		w = worker()
+	}
+	k := NewKernel(w)
+	k.log = log
 	k.Message = *(in.Clone())
 	k.withFS = withFS
 
@@ -259,7 +546,7 @@ func (r *RuleSet) Evaluate(in *Message, env map[string]string, withFS bool, work
 			switch x := rule.(type) {
 			case *Rule:
 				ok, done, err := k.Execute(x, env)
-				logger.Printf(logger.DBG, "! %s -> ok=%v, done=%v", x.String(), ok, done)
+				log.Debug("rule", "rule", x.String(), "ok", ok, "done", done)
 				if err != nil {
 					return nil, err
 				}
@@ -271,9 +558,9 @@ func (r *RuleSet) Evaluate(in *Message, env map[string]string, withFS bool, work
 				}
 			case []any:
 				st.Push(k.Clone())
-				logger.Println(logger.DBG, "! branch down")
+				log.Debug("branch down")
 				out, err := eval(x)
-				logger.Printf(logger.DBG, "! branch up -> out=%v, err=%v", out != nil, err)
+				log.Debug("branch up", "out", out != nil, "error", err)
 				k = st.Pop().(*Kernel)
 				if err != nil || out != nil {
 					return out, err